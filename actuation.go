@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// how long we wait for a driver to carry out an actuation
+const actuationTimeout = 10 * time.Second
+
+// PO number of the ActuationResult we publish for every write to a slot
+const actuationResultPO = "2.0.9.5"
+
+// the sMAP actuator models
+const (
+	// a fixed set of two states, by default 0 (off) and 1 (on)
+	actuatorBinary = "binary"
+	// a fixed set of states
+	actuatorDiscrete = "discrete"
+	// any number within a range
+	actuatorContinuous = "continuous"
+)
+
+// the payload data formats we accept for writes to a slot
+const (
+	msgPackDF = "2.0.0.0/8"
+	textDF    = "64.0.0.0/4"
+)
+
+// what an actuatable point accepts, as described by the Actuator dictionary
+// of its sMAP message
+type actuatorModel struct {
+	Model string
+	// for binary and discrete actuators. Each state is a list of aliases; the
+	// first one is what we send to the driver
+	States [][]string
+	// for continuous actuators
+	Min, Max float64
+}
+
+// parses the Actuator dictionary of a sMAP message
+func parseActuator(desc map[string]interface{}) (*actuatorModel, error) {
+	model := &actuatorModel{}
+	name, _ := desc["Model"].(string)
+	model.Model = strings.ToLower(name)
+	switch model.Model {
+	case actuatorBinary:
+		states, err := parseStates(desc["States"])
+		if err != nil {
+			return nil, err
+		}
+		if len(states) == 0 {
+			states = [][]string{{"0", "off"}, {"1", "on"}}
+		}
+		if len(states) != 2 {
+			return nil, fmt.Errorf("Binary actuator has %d states", len(states))
+		}
+		model.States = states
+	case actuatorDiscrete:
+		states, err := parseStates(desc["States"])
+		if err != nil {
+			return nil, err
+		}
+		if len(states) == 0 {
+			return nil, errors.New("Discrete actuator has no states")
+		}
+		model.States = states
+	case actuatorContinuous:
+		// sMAP puts the range in States; some drivers use MinValue and MaxValue
+		var (
+			limits []interface{}
+			err    error
+		)
+		if states, found := desc["States"].([]interface{}); found {
+			limits = states
+		} else {
+			limits = []interface{}{desc["MinValue"], desc["MaxValue"]}
+		}
+		if len(limits) != 2 {
+			return nil, fmt.Errorf("Continuous actuator has invalid range %v", limits)
+		}
+		if model.Min, err = toFloat(limits[0]); err != nil {
+			return nil, errors.Wrap(err, "Continuous actuator has invalid minimum")
+		}
+		if model.Max, err = toFloat(limits[1]); err != nil {
+			return nil, errors.Wrap(err, "Continuous actuator has invalid maximum")
+		}
+		if model.Min > model.Max {
+			return nil, fmt.Errorf("Continuous actuator has empty range [%v, %v]", model.Min, model.Max)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown actuator model %q", name)
+	}
+	return model, nil
+}
+
+// States is a list whose entries are either a single state or a list of
+// aliases for one state
+func parseStates(value interface{}) ([][]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Actuator has invalid states %v", value)
+	}
+	var states [][]string
+	for _, entry := range list {
+		var aliases []string
+		if entryList, ok := entry.([]interface{}); ok {
+			for _, alias := range entryList {
+				aliases = append(aliases, toString(alias))
+			}
+		} else {
+			aliases = append(aliases, toString(entry))
+		}
+		if len(aliases) == 0 {
+			return nil, fmt.Errorf("Actuator has an empty state in %v", value)
+		}
+		states = append(states, aliases)
+	}
+	return states, nil
+}
+
+// Checks the value against the model and returns what we send to the driver
+func (m *actuatorModel) validate(value interface{}) (string, error) {
+	if m.Model == actuatorContinuous {
+		number, err := toFloat(value)
+		if err != nil {
+			return "", errors.Wrapf(err, "Invalid value %v for continuous actuator", value)
+		}
+		if number < m.Min || number > m.Max {
+			return "", fmt.Errorf("Value %v is outside of [%v, %v]", number, m.Min, m.Max)
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+	}
+	state := toString(value)
+	for _, aliases := range m.States {
+		for _, alias := range aliases {
+			if sameState(state, alias) {
+				return aliases[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Value %v is not a state of the %s actuator", value, m.Model)
+}
+
+// states match if they are the same number or the same string, ignoring case
+func sameState(a, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	fa, erra := strconv.ParseFloat(a, 64)
+	fb, errb := strconv.ParseFloat(b, 64)
+	return erra == nil && errb == nil && fa == fb
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("%v is not a number", value)
+	}
+}
+
+// published on the interface's actuation signal for every write to a slot
+type ActuationResult struct {
+	// the name of the slot that was written
+	Slot string
+	// the sMAP path of the point
+	Path string
+	UUID string
+	// the value that was written to the slot
+	Value interface{}
+	// the time the driver answered, in nanoseconds
+	Time    int64
+	Success bool
+	Error   string
+}
+
+// an actuatable point that we listen for writes on
+type actuatablePoint struct {
+	vk          string
+	name        string
+	uuid        string
+	path        string
+	actuatorURL string
+	model       *actuatorModel
+	slot        string
+	signal      string
+	// set when a newer subscription took over the slot
+	replaced bool
+	sync.Mutex
+}
+
+// Forwards writes on the slots of actuatable points to the actuators of the
+// sMAP drivers. Points are added as reports come in
+type actuationBridge struct {
+	publisher Publisher
+	client    *http.Client
+	// slot uri -> point
+	points map[string]*actuatablePoint
+	// slots we are subscribing to
+	subscribing map[string]bool
+	sync.Mutex
+}
+
+func newActuationBridge(publisher Publisher) *actuationBridge {
+	return &actuationBridge{
+		publisher:   publisher,
+		client:      &http.Client{Timeout: actuationTimeout},
+		points:      make(map[string]*actuatablePoint),
+		subscribing: make(map[string]bool),
+	}
+}
+
+// Listens for writes to the point on <iface>/slot/<name> if the message
+// describes an actuator and the source has an actuator URL. Returns the slot,
+// or nil if the point can't be actuated
+func (b *actuationBridge) register(src *source, msg SmapMessage, iface, name string) (*SlotDescriptor, error) {
+	if src.actuatorURL == "" || len(msg.Actuator) == 0 {
+		return nil, nil
+	}
+	model, err := parseActuator(msg.Actuator)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not parse actuator of %s", msg.Path)
+	}
+	slot := iface + "/slot/" + name
+	descriptor := &SlotDescriptor{Name: name, URI: slot, Path: msg.Path, Model: model.Model}
+
+	b.Lock()
+	if point, found := b.points[slot]; found && point.path != msg.Path {
+		b.Unlock()
+		// never send writes meant for one point to another
+		return nil, fmt.Errorf("Slot %s is already used by %s; not forwarding writes to %s", slot, point.path, msg.Path)
+	}
+	if point, found := b.points[slot]; found && point.vk == src.vk {
+		b.Unlock()
+		// the driver may have changed the model
+		point.Lock()
+		point.uuid = msg.UUID
+		point.actuatorURL = src.actuatorURL
+		point.model = model
+		point.Unlock()
+		return descriptor, nil
+	}
+	if b.subscribing[slot] {
+		// another report is subscribing; the slot is described once it's done
+		b.Unlock()
+		return nil, nil
+	}
+	b.subscribing[slot] = true
+	b.Unlock()
+
+	// don't hold up other reports while we wait for the agent
+	c, err := b.publisher.Subscribe(src.vk, slot)
+
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribing, slot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not subscribe to %s", slot)
+	}
+	if old, found := b.points[slot]; found {
+		// the source's entity changed. The old subscription can't be
+		// cancelled, so its listener keeps draining it but ignores writes
+		old.Lock()
+		old.replaced = true
+		old.Unlock()
+	}
+	point := &actuatablePoint{
+		vk:          src.vk,
+		name:        name,
+		uuid:        msg.UUID,
+		path:        msg.Path,
+		actuatorURL: src.actuatorURL,
+		model:       model,
+		slot:        slot,
+		signal:      iface + "/signal/actuation",
+	}
+	b.points[slot] = point
+	log.Noticef("Forwarding writes on %s to %s%s", slot, src.actuatorURL, msg.Path)
+	go b.listen(point, c)
+	return descriptor, nil
+}
+
+// handles writes until the subscription ends, then forgets the point so
+// that the next report subscribes again
+func (b *actuationBridge) listen(point *actuatablePoint, c chan *bw2.SimpleMessage) {
+	for msg := range c {
+		point.Lock()
+		replaced := point.replaced
+		point.Unlock()
+		if !replaced {
+			b.handle(point, msg)
+		}
+	}
+	log.Warningf("Subscription to %s ended", point.slot)
+	b.Lock()
+	defer b.Unlock()
+	if b.points[point.slot] == point {
+		delete(b.points, point.slot)
+	}
+}
+
+// carries out one write and publishes the result
+func (b *actuationBridge) handle(point *actuatablePoint, msg *bw2.SimpleMessage) {
+	point.Lock()
+	var (
+		vk          = point.vk
+		path        = point.path
+		actuatorURL = point.actuatorURL
+		model       = point.model
+		result      = ActuationResult{Slot: point.name, Path: point.path, UUID: point.uuid}
+	)
+	point.Unlock()
+
+	var state string
+	value, err := writtenValue(msg)
+	result.Value = value
+	if err == nil {
+		state, err = model.validate(value)
+	}
+	if err != nil {
+		actuationsTotal.WithLabelValues(actuationInvalid).Inc()
+	} else if err = b.actuate(actuatorURL, path, state); err != nil {
+		actuationsTotal.WithLabelValues(actuationFailed).Inc()
+	} else {
+		actuationsTotal.WithLabelValues(actuationOK).Inc()
+	}
+	result.Time = time.Now().UnixNano()
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+		log.Warningf("Write from %s to %s: %s", msg.From, point.slot, err)
+	} else {
+		log.Infof("Set %s to %s for %s", path, state, msg.From)
+	}
+
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(actuationResultPO), result)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Could not encode actuation result"))
+		return
+	}
+	if err := b.publisher.Publish(vk, point.signal, po); err != nil {
+		log.Error(errors.Wrapf(err, "Could not publish actuation result on %s", point.signal))
+	}
+}
+
+// keys that hold the value in dictionaries written to a slot
+var stateKeys = []string{"state", "State", "value", "Value"}
+
+// Extracts the value from a write to a slot. We accept a msgpack payload that
+// is either the value itself or a dictionary with a "state" (or "Value") key,
+// or a text payload
+func writtenValue(msg *bw2.SimpleMessage) (interface{}, error) {
+	for _, po := range msg.POs {
+		if po.IsTypeDF(msgPackDF) {
+			mp, err := bw2.LoadMsgPackPayloadObject(po.GetPONum(), po.GetContents())
+			if err != nil {
+				return nil, errors.Wrap(err, "Could not decode msgpack payload")
+			}
+			var value interface{}
+			if err := mp.ValueInto(&value); err != nil {
+				return nil, errors.Wrap(err, "Could not decode msgpack payload")
+			}
+			switch dict := value.(type) {
+			case map[interface{}]interface{}:
+				for _, key := range stateKeys {
+					if v, found := dict[key]; found {
+						return v, nil
+					}
+				}
+				return nil, errors.New("Msgpack payload has no state")
+			case map[string]interface{}:
+				for _, key := range stateKeys {
+					if v, found := dict[key]; found {
+						return v, nil
+					}
+				}
+				return nil, errors.New("Msgpack payload has no state")
+			}
+			return value, nil
+		}
+		if po.IsTypeDF(textDF) {
+			return strings.TrimSpace(string(po.GetContents())), nil
+		}
+	}
+	return nil, errors.New("Message has no msgpack or text payload")
+}
+
+// asks the driver to set the point at path to state
+func (b *actuationBridge) actuate(actuatorURL, path, state string) error {
+	target := actuationTarget(actuatorURL, path, state)
+	req, err := http.NewRequest("PUT", target, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid actuator URL %s", target)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Could not reach actuator %s", target)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Actuator %s returned %s: %s", target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// returns <actuatorURL><path>?state=<state>, escaping each segment of the sMAP
+// path and the state
+func actuationTarget(actuatorURL, path, state string) string {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return actuatorURL + "/" + strings.Join(segments, "/") + "?" + url.Values{"state": {state}}.Encode()
+}
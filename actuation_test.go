@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decodes an Actuator dictionary the way reports are decoded
+func testActuator(t *testing.T, desc string) map[string]interface{} {
+	var actuator map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(desc))
+	dec.UseNumber()
+	if err := dec.Decode(&actuator); err != nil {
+		t.Fatal(err)
+	}
+	return actuator
+}
+
+func TestParseActuatorInvalid(t *testing.T) {
+	for _, desc := range []string{
+		`{}`,
+		`{"Model": "toggle"}`,
+		`{"Model": "binary", "States": [["0", "off"], ["1", "on"], ["2", "auto"]]}`,
+		`{"Model": "binary", "States": "on/off"}`,
+		`{"Model": "discrete"}`,
+		`{"Model": "discrete", "States": [[]]}`,
+		`{"Model": "continuous"}`,
+		`{"Model": "continuous", "States": [0]}`,
+		`{"Model": "continuous", "States": [100, 0]}`,
+		`{"Model": "continuous", "States": ["low", "high"]}`,
+	} {
+		if model, err := parseActuator(testActuator(t, desc)); err == nil {
+			t.Errorf("Parsed invalid actuator %s as %+v", desc, model)
+		}
+	}
+}
+
+func TestActuatorValidate(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		value    interface{}
+		expected string
+		valid    bool
+	}{
+		// binary actuators default to 0/off and 1/on
+		{`{"Model": "binary"}`, "ON", "1", true},
+		{`{"Model": "binary"}`, "off", "0", true},
+		{`{"Model": "binary"}`, json.Number("1"), "1", true},
+		{`{"Model": "binary"}`, 1.0, "1", true},
+		{`{"Model": "binary"}`, true, "1", true},
+		{`{"Model": "binary"}`, "2", "", false},
+		{`{"Model": "Binary", "States": [["closed", "0"], ["open", "1"]]}`, "1", "open", true},
+		{`{"Model": "discrete", "States": ["heat", "cool", "auto"]}`, "Cool", "cool", true},
+		{`{"Model": "discrete", "States": ["heat", "cool", "auto"]}`, "off", "", false},
+		{`{"Model": "discrete", "States": [1, 2, 3]}`, "2.0", "2", true},
+		{`{"Model": "continuous", "States": [0, 100]}`, json.Number("42.5"), "42.5", true},
+		{`{"Model": "continuous", "States": [0, 100]}`, "100", "100", true},
+		{`{"Model": "continuous", "States": [0, 100]}`, 100.5, "", false},
+		{`{"Model": "continuous", "States": [0, 100]}`, -1.0, "", false},
+		{`{"Model": "continuous", "States": [0, 100]}`, "half", "", false},
+		{`{"Model": "continuous", "MinValue": 55, "MaxValue": 80}`, 72.0, "72", true},
+	} {
+		model, err := parseActuator(testActuator(t, test.desc))
+		if err != nil {
+			t.Errorf("Could not parse %s: %s", test.desc, err)
+			continue
+		}
+		state, err := model.validate(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: validating %v returned %v", test.desc, test.value, err)
+		} else if test.valid && state != test.expected {
+			t.Errorf("%s: %v became %q, expected %q", test.desc, test.value, state, test.expected)
+		}
+	}
+}
+
+func TestActuationTarget(t *testing.T) {
+	for _, test := range []struct {
+		path, state string
+		expected    string
+	}{
+		{"/vav1/damper", "1", "http://localhost:8080/data/vav1/damper?state=1"},
+		{"/vav 1/damper #2", "on", "http://localhost:8080/data/vav%201/damper%20%232?state=on"},
+		{"/vav1/what?", "a&b=c", "http://localhost:8080/data/vav1/what%3F?state=a%26b%3Dc"},
+	} {
+		if target := actuationTarget("http://localhost:8080/data", test.path, test.state); target != test.expected {
+			t.Errorf("Target for %q = %q is %s, expected %s", test.path, test.state, target, test.expected)
+		}
+	}
+}
+
+func TestActuate(t *testing.T) {
+	var path, state string
+	driver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			http.Error(w, "Expected PUT", 405)
+			return
+		}
+		path, state = r.URL.Path, r.URL.Query().Get("state")
+		if state == "jammed" {
+			http.Error(w, "Damper is jammed", 500)
+		}
+	}))
+	defer driver.Close()
+
+	b := newActuationBridge(newMemoryPublisher())
+	if err := b.actuate(driver.URL+"/data", "/vav 1/damper #2", "on"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/data/vav 1/damper #2" || state != "on" {
+		t.Errorf("Driver got path %q and state %q", path, state)
+	}
+	if err := b.actuate(driver.URL+"/data", "/vav1/damper", "jammed"); err == nil {
+		t.Error("Expected an error when the driver fails")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"goji.io"
+	"goji.io/pat"
+)
+
+// the largest entity file we accept over the admin socket
+const maxEntitySize = 1 << 20
+
+// response from the admin API after adding or rotating an entity
+type entityResponse struct {
+	VK string
+}
+
+// Serves the admin API on a Unix domain socket at the given path. Only the
+// user running the server can connect, so registering entities is as
+// protected as the entity files themselves
+func (s *server) serveAdmin(socket string) error {
+	// remove a socket left over from a previous run
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Could not remove old admin socket %s", socket)
+	}
+	// create the socket without group or other permissions; changing them
+	// after Listen would leave a window in which anyone could connect
+	oldmask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socket)
+	syscall.Umask(oldmask)
+	if err != nil {
+		return errors.Wrapf(err, "Could not listen on admin socket %s", socket)
+	}
+
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Get("/entities"), s.adminListEntities)
+	mux.HandleFunc(pat.Get("/entities/:vk"), s.adminGetEntity)
+	mux.HandleFunc(pat.Post("/entities"), s.adminAddEntity)
+	mux.HandleFunc(pat.Delete("/entities/:vk"), s.adminRemoveEntity)
+	mux.HandleFunc(pat.Post("/entities/:vk/rotate"), s.adminRotateEntity)
+
+	log.Noticef("Serving admin API on %s", socket)
+	go func() {
+		log.Fatal(http.Serve(listener, mux))
+	}()
+	return nil
+}
+
+func (s *server) adminListEntities(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.store.listEntities()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, infos)
+}
+
+func (s *server) adminGetEntity(w http.ResponseWriter, r *http.Request) {
+	vk := pat.Param(r, "vk")
+	info, err := s.store.getEntity(vk)
+	if err == errUnknownVK {
+		http.Error(w, fmt.Sprintf("%s %s", err, vk), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// the request body is the contents of the entity file
+func (s *server) adminAddEntity(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEntitySize))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	vk, err := s.store.addEntity(contents)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	writeJSON(w, entityResponse{VK: vk})
+}
+
+func (s *server) adminRemoveEntity(w http.ResponseWriter, r *http.Request) {
+	vk := pat.Param(r, "vk")
+	if err := s.store.removeEntity(vk); err == errUnknownVK {
+		http.Error(w, fmt.Sprintf("%s %s", err, vk), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// the request body is the contents of the new entity file
+func (s *server) adminRotateEntity(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	vk := pat.Param(r, "vk")
+	contents, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEntitySize))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	newvk, err := s.store.rotateEntity(vk, contents)
+	if err == errUnknownVK {
+		http.Error(w, fmt.Sprintf("%s %s", err, vk), 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	writeJSON(w, entityResponse{VK: newvk})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error(errors.Wrap(err, "Could not encode response"))
+	}
+}
+
+// client for the admin API of a running server
+type adminClient struct {
+	http *http.Client
+}
+
+func newAdminClient(socket string) *adminClient {
+	return &adminClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// performs the request and decodes the JSON response into result (if not nil)
+func (c *adminClient) do(method, path string, body []byte, result interface{}) error {
+	// the host is ignored; we always dial the socket
+	req, err := http.NewRequest(method, "http://sWAP"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Could not reach sWAP server (is it running?)")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("sWAP server returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *adminClient) addEntity(contents []byte) (string, error) {
+	var resp entityResponse
+	err := c.do("POST", "/entities", contents, &resp)
+	return resp.VK, err
+}
+
+func (c *adminClient) listEntities() ([]entityInfo, error) {
+	var infos []entityInfo
+	err := c.do("GET", "/entities", nil, &infos)
+	return infos, err
+}
+
+func (c *adminClient) getEntity(vk string) (*entityInfo, error) {
+	var info entityInfo
+	if err := c.do("GET", "/entities/"+vk, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *adminClient) removeEntity(vk string) error {
+	return c.do("DELETE", "/entities/"+vk, nil, nil)
+}
+
+func (c *adminClient) rotateEntity(vk string, contents []byte) (string, error) {
+	var resp entityResponse
+	err := c.do("POST", "/entities/"+vk+"/rotate", contents, &resp)
+	return resp.VK, err
+}
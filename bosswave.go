@@ -1,13 +1,29 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 
 	bw2 "gopkg.in/immesys/bw2bind.v5"
 )
 
+// PO numbers for the messages we publish
+const (
+	// one DataMessage per numeric reading
+	dataMessagePO = "2.0.0.0"
+	// one BatchMessage per sMAP message
+	batchMessagePO = "2.0.9.2"
+	// one ObjectMessage per object reading
+	objectMessagePO = "2.0.9.3"
+	// one BatchObjectMessage per sMAP message
+	batchObjectMessagePO = "2.0.9.4"
+	// one TimeseriesReading per numeric reading of an unresolved UUID
+	timeseriesReadingPO = "2.0.9.1"
+)
+
 type SmapParams struct {
-	Data           [][]json.Number
+	Data           []SmapReading
+	UnitOfTime     UnitOfTime
+	StreamType     StreamType
 	URI            string
 	Name           string
 	Class          string
@@ -21,37 +37,208 @@ type DataMessage struct {
 	Name, Class, Equipment, EquipmentClass string
 }
 
-func (s *server) publish(params SmapParams) error {
+// all readings from a single sMAP message for one point
+type BatchMessage struct {
+	Name, Class, Equipment, EquipmentClass string
+	Readings                               []BatchReading
+}
+
+type BatchReading struct {
+	Time  int64
+	Value float64
+}
+
+// a reading whose value is a string, boolean, list or dictionary
+type ObjectMessage struct {
+	Time                                   int64
+	Value                                  interface{}
+	Name, Class, Equipment, EquipmentClass string
+}
+
+// all object readings from a single sMAP message for one point
+type BatchObjectMessage struct {
+	Name, Class, Equipment, EquipmentClass string
+	Readings                               []BatchObjectReading
+}
+
+type BatchObjectReading struct {
+	Time  int64
+	Value interface{}
+}
+
+// the original sWAP message; used for timeseries we couldn't resolve
+type TimeseriesReading struct {
+	UUID  string
+	Time  int64
+	Value float64
+}
+
+// Returns true if any of the readings were buffered rather than published
+func (s *server) publish(src *source, params SmapParams) (bool, error) {
+	// split the readings into numeric and object readings. If the driver told us
+	// the stream type, we go by that; otherwise, we decide for each reading
+	var (
+		numeric  []BatchReading
+		objects  []BatchObjectReading
+		buffered bool
+	)
 	for _, datum := range params.Data {
-		var msg = DataMessage{
+		// a missing reading; there is nothing to publish
+		if datum.Null() {
+			continue
+		}
+		time, err := normalizeTime(datum.Time, params.UnitOfTime, src.timeUnit)
+		if err != nil {
+			return buffered, err
+		}
+		if params.StreamType != OBJECT_STREAM {
+			if value, ok := datum.Number(); ok {
+				numeric = append(numeric, BatchReading{Time: time, Value: value})
+				continue
+			} else if params.StreamType == NUMERIC_STREAM {
+				return buffered, fmt.Errorf("Reading %s for numeric stream %s is not a number", datum.Value, params.Name)
+			}
+		}
+		value, err := datum.Object()
+		if err != nil {
+			return buffered, err
+		}
+		objects = append(objects, BatchObjectReading{Time: time, Value: value})
+	}
+
+	if src.batch {
+		return s.publishBatch(src, params, numeric, objects)
+	}
+	ponum := dataMessagePO
+	if src.ponum != "" {
+		ponum = src.ponum
+	}
+	for _, rdg := range numeric {
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(ponum), DataMessage{
+			Time:           rdg.Time,
+			Value:          rdg.Value,
 			Name:           params.Name,
 			Class:          params.Class,
 			Equipment:      params.Equipment,
 			EquipmentClass: params.EquipmentClass,
+		})
+		if err != nil {
+			return buffered, err
 		}
-		if time, err := datum[0].Int64(); err != nil {
-			return err
-		} else {
-			msg.Time = time
+		b, err := s.queue.publish(src.vk, params.URI, po)
+		if err != nil {
+			return buffered, err
 		}
-
-		if value, err := datum[1].Float64(); err != nil {
-			return err
-		} else {
-			msg.Value = value
+		buffered = buffered || b
+	}
+	for _, rdg := range objects {
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(objectMessagePO), ObjectMessage{
+			Time:           rdg.Time,
+			Value:          rdg.Value,
+			Name:           params.Name,
+			Class:          params.Class,
+			Equipment:      params.Equipment,
+			EquipmentClass: params.EquipmentClass,
+		})
+		if err != nil {
+			return buffered, err
 		}
+		b, err := s.queue.publish(src.vk, params.URI, po)
+		if err != nil {
+			return buffered, err
+		}
+		buffered = buffered || b
+	}
+
+	return buffered, nil
+}
 
-		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm("2.0.0.0"), msg)
+// publishes the numeric readings as a single BatchMessage and the object readings
+// as a single BatchObjectMessage
+func (s *server) publishBatch(src *source, params SmapParams, numeric []BatchReading, objects []BatchObjectReading) (bool, error) {
+	var buffered bool
+	if len(numeric) > 0 {
+		ponum := batchMessagePO
+		if src.ponum != "" {
+			ponum = src.ponum
+		}
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(ponum), BatchMessage{
+			Name:           params.Name,
+			Class:          params.Class,
+			Equipment:      params.Equipment,
+			EquipmentClass: params.EquipmentClass,
+			Readings:       numeric,
+		})
 		if err != nil {
-			return err
+			return buffered, err
 		}
-		if err := s.bw2.Publish(&bw2.PublishParams{
-			URI:            params.URI,
-			PayloadObjects: []bw2.PayloadObject{po},
-		}); err != nil {
-			return err
+		b, err := s.queue.publish(src.vk, params.URI, po)
+		if err != nil {
+			return buffered, err
 		}
+		buffered = buffered || b
 	}
+	if len(objects) > 0 {
+		po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(batchObjectMessagePO), BatchObjectMessage{
+			Name:           params.Name,
+			Class:          params.Class,
+			Equipment:      params.Equipment,
+			EquipmentClass: params.EquipmentClass,
+			Readings:       objects,
+		})
+		if err != nil {
+			return buffered, err
+		}
+		b, err := s.queue.publish(src.vk, params.URI, po)
+		if err != nil {
+			return buffered, err
+		}
+		buffered = buffered || b
+	}
+	return buffered, nil
+}
 
-	return nil
+// Publishes the readings of a timeseries we couldn't resolve on the given
+// URI. Numeric readings are published as TimeseriesReadings; object readings
+// as ObjectMessages named after the sMAP path
+func (s *server) publishUnresolved(src *source, uri string, msg SmapMessage) (bool, error) {
+	var buffered bool
+	for _, datum := range msg.Readings {
+		if datum.Null() {
+			continue
+		}
+		time, err := normalizeTime(datum.Time, msg.UnitOfTime(), src.timeUnit)
+		if err != nil {
+			return buffered, err
+		}
+		var po bw2.PayloadObject
+		if value, ok := datum.Number(); ok && msg.StreamType() != OBJECT_STREAM {
+			po, err = bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(timeseriesReadingPO), TimeseriesReading{
+				UUID:  msg.UUID,
+				Time:  time,
+				Value: value,
+			})
+		} else if msg.StreamType() == NUMERIC_STREAM {
+			return buffered, fmt.Errorf("Reading %s for numeric stream %s is not a number", datum.Value, msg.Path)
+		} else {
+			var value interface{}
+			if value, err = datum.Object(); err != nil {
+				return buffered, err
+			}
+			po, err = bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(objectMessagePO), ObjectMessage{
+				Time:  time,
+				Value: value,
+				Name:  msg.Path,
+			})
+		}
+		if err != nil {
+			return buffered, err
+		}
+		b, err := s.queue.publish(src.vk, uri, po)
+		if err != nil {
+			return buffered, err
+		}
+		buffered = buffered || b
+	}
+	return buffered, nil
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// the Brick context for a sMAP timeseries as resolved from Hod
+type pointInfo struct {
+	Name              string
+	Class             string
+	Equipment         string
+	EquipmentClass    string
+	GenericClass      string
+	GenericEquipClass string
+	// interface name of the generic equipment class
+	EquipInterface string
+}
+
+type cacheEntry struct {
+	// nil if the UUID had no results in Hod
+	info    *pointInfo
+	expires time.Time
+}
+
+// caches the resolution of sMAP UUIDs to Brick points and equipment so we
+// don't have to query Hod for every incoming message. UUIDs that don't resolve
+// are cached too (with a nil info) so unmapped points don't hit Hod every time
+type resolutionCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[string]cacheEntry
+	sync.RWMutex
+}
+
+func newResolutionCache(ttl, negativeTTL time.Duration) *resolutionCache {
+	c := &resolutionCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]cacheEntry),
+	}
+	go c.expireLoop()
+	return c
+}
+
+// returns the cached resolution for the UUID. If found is false, the UUID needs
+// to be resolved; if found is true and info is nil, the UUID is known to have no results
+func (c *resolutionCache) get(uuid string) (info *pointInfo, found bool) {
+	c.RLock()
+	defer c.RUnlock()
+	entry, found := c.entries[uuid]
+	if !found || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.info, true
+}
+
+// caches the resolution for the UUID. A nil info marks the UUID as unresolvable
+func (c *resolutionCache) put(uuid string, info *pointInfo) {
+	ttl := c.ttl
+	if info == nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries[uuid] = cacheEntry{info: info, expires: time.Now().Add(ttl)}
+}
+
+// removes the UUID from the cache so it is resolved again on the next message
+func (c *resolutionCache) invalidate(uuid string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, uuid)
+}
+
+// removes all entries from the cache
+func (c *resolutionCache) purge() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[string]cacheEntry)
+}
+
+// periodically drops expired entries so the cache doesn't hold on to
+// UUIDs we no longer hear from
+func (c *resolutionCache) expireLoop() {
+	interval := c.ttl
+	if c.negativeTTL > 0 && (interval <= 0 || c.negativeTTL < interval) {
+		interval = c.negativeTTL
+	}
+	if interval <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	for _ = range tick.C {
+		now := time.Now()
+		c.Lock()
+		for uuid, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, uuid)
+			}
+		}
+		c.Unlock()
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolutionCacheTTL(t *testing.T) {
+	c := newResolutionCache(50*time.Millisecond, 200*time.Millisecond)
+	info := &pointInfo{Name: "soda#VAV1_ZNT"}
+	c.put("resolved", info)
+	c.put("unresolved", nil)
+
+	if cached, found := c.get("resolved"); !found || cached != info {
+		t.Errorf("Expected the resolution to be cached, got %+v (found %v)", cached, found)
+	}
+	// a nil info means the UUID is known not to resolve
+	if cached, found := c.get("unresolved"); !found || cached != nil {
+		t.Errorf("Expected a negative entry, got %+v (found %v)", cached, found)
+	}
+	if _, found := c.get("unknown"); found {
+		t.Error("Found a UUID that was never cached")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, found := c.get("resolved"); found {
+		t.Error("Resolution outlived its TTL")
+	}
+	if _, found := c.get("unresolved"); !found {
+		t.Error("Negative entry expired before its own TTL")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, found := c.get("unresolved"); found {
+		t.Error("Negative entry outlived its TTL")
+	}
+}
+
+func TestResolutionCacheDisabled(t *testing.T) {
+	// a TTL of zero turns off that kind of caching
+	c := newResolutionCache(time.Minute, 0)
+	c.put("resolved", &pointInfo{Name: "soda#VAV1_ZNT"})
+	c.put("unresolved", nil)
+	if _, found := c.get("resolved"); !found {
+		t.Error("Expected the resolution to be cached")
+	}
+	if _, found := c.get("unresolved"); found {
+		t.Error("Cached a negative entry with negative caching off")
+	}
+}
+
+func TestResolutionCacheInvalidate(t *testing.T) {
+	c := newResolutionCache(time.Minute, time.Minute)
+	c.put("a", &pointInfo{Name: "a"})
+	c.put("b", nil)
+	c.put("c", &pointInfo{Name: "c"})
+
+	c.invalidate("a")
+	if _, found := c.get("a"); found {
+		t.Error("Invalidated UUID is still cached")
+	}
+	if _, found := c.get("b"); !found {
+		t.Error("Invalidating one UUID dropped another")
+	}
+	c.purge()
+	for _, uuid := range []string{"b", "c"} {
+		if _, found := c.get(uuid); found {
+			t.Errorf("%s is still cached after a purge", uuid)
+		}
+	}
+}
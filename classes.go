@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// answers rdfs:subClassOf* queries for the class index
+type classSource interface {
+	// returns all subclasses of the given Brick class
+	subclassesOf(class string) ([]string, error)
+}
+
+// asks Hod for subclasses
+type hodClassSource struct {
+	client *hodConn
+}
+
+func (src hodClassSource) subclassesOf(class string) ([]string, error) {
+	query := fmt.Sprintf(`SELECT ?class WHERE {
+            ?class rdfs:subClassOf* brick:%s .
+        };`, class)
+	start := time.Now()
+	res, err := src.client.DoQuery(query, nil)
+	hodQueryDuration.WithLabelValues("subclasses").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	var subclasses []string
+	for _, row := range res.Rows {
+		subclasses = append(subclasses, row["?class"].Value)
+	}
+	return subclasses, nil
+}
+
+// in-memory copy of the rdfs:subClassOf* closure for each of the generic
+// classes, so that classifying a Brick class doesn't need a round trip to Hod
+// (or wherever the source gets its answers)
+type classIndex struct {
+	source classSource
+	// generic classes, in order of precedence
+	roots taxonomy
+	// root class -> set of all of its subclasses (including itself)
+	closure map[string]map[string]bool
+	sync.RWMutex
+}
+
+// creates the index and loads the closure for each of the roots from the source
+func newClassIndex(source classSource, roots taxonomy) (*classIndex, error) {
+	idx := &classIndex{
+		source:  source,
+		roots:   roots,
+		closure: make(map[string]map[string]bool),
+	}
+	if _, err := idx.load(); err != nil {
+		return nil, err
+	}
+	if err := idx.checkShadowed(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// fetches the subclass closure for all roots from the source and swaps it in.
+// Returns true if the closure differs from what we had before
+func (idx *classIndex) load() (bool, error) {
+	closure := make(map[string]map[string]bool)
+	for _, entry := range idx.roots {
+		root := entry.Class
+		classes, err := idx.source.subclassesOf(root)
+		if err != nil {
+			return false, errors.Wrapf(err, "Could not load subclasses of %s", root)
+		}
+		subclasses := make(map[string]bool)
+		for _, class := range classes {
+			subclasses[class] = true
+		}
+		if len(subclasses) == 0 {
+			log.Warningf("No subclasses found for %s", root)
+		}
+		// a class is always a subclass of itself
+		subclasses[root] = true
+		closure[root] = subclasses
+	}
+
+	idx.Lock()
+	defer idx.Unlock()
+	changed := !sameClosure(idx.closure, closure)
+	idx.closure = closure
+	return changed, nil
+}
+
+// returns true if subclass is in the closure of the given root class
+func (idx *classIndex) isSubclassOf(subclass, superclass string) bool {
+	idx.RLock()
+	defer idx.RUnlock()
+	return idx.closure[superclass][subclass]
+}
+
+// returns the first generic class (in order of precedence) that the given class
+// is a subclass of, or nil if it falls under none of them
+func (idx *classIndex) classify(class string) *genericClass {
+	idx.RLock()
+	defer idx.RUnlock()
+	for i, entry := range idx.roots {
+		if idx.closure[entry.Class][class] {
+			return &idx.roots[i]
+		}
+	}
+	return nil
+}
+
+// returns an error if a generic class can never be matched because it is a
+// subclass of another generic class with a lower precedence value
+func (idx *classIndex) checkShadowed() error {
+	idx.RLock()
+	defer idx.RUnlock()
+	for i, entry := range idx.roots {
+		for _, earlier := range idx.roots[:i] {
+			if idx.closure[earlier.Class][entry.Class] {
+				return fmt.Errorf("Class %s (precedence %d) is a subclass of %s (precedence %d) and will never be matched",
+					entry.Class, entry.Precedence, earlier.Class, earlier.Precedence)
+			}
+		}
+	}
+	return nil
+}
+
+func sameClosure(a, b map[string]map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for root, subclasses := range a {
+		other, found := b[root]
+		if !found || len(other) != len(subclasses) {
+			return false
+		}
+		for class := range subclasses {
+			if !other[class] {
+				return false
+			}
+		}
+	}
+	return true
+}
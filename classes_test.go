@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+var testTaxonomy = taxonomy{
+	{Class: "Damper", Interface: "Damper", Precedence: 1},
+	{Class: "VAV", Interface: "VAV", Precedence: 2},
+	{Class: "Sensor", Interface: "Sensor", Precedence: 3},
+}
+
+func TestClassify(t *testing.T) {
+	idx, err := newClassIndex(staticClasses{
+		"Damper": {"Damper", "Damper_Position_Sensor"},
+		"VAV":    {"VAV", "RVAV"},
+		"Sensor": {"Sensor", "Zone_Temperature_Sensor", "Damper_Position_Sensor"},
+	}, testTaxonomy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		class    string
+		expected string
+	}{
+		{"Zone_Temperature_Sensor", "Sensor"},
+		{"Sensor", "Sensor"},
+		{"RVAV", "VAV"},
+		// under both Damper and Sensor; Damper has the lower precedence value
+		{"Damper_Position_Sensor", "Damper"},
+		{"AHU", ""},
+	} {
+		var class string
+		if generic := idx.classify(test.class); generic != nil {
+			class = generic.Class
+		}
+		if class != test.expected {
+			t.Errorf("Classified %s as %q, expected %q", test.class, class, test.expected)
+		}
+	}
+	if !idx.isSubclassOf("RVAV", "VAV") || idx.isSubclassOf("RVAV", "Sensor") {
+		t.Error("Wrong subclass relation for RVAV")
+	}
+}
+
+func TestClassIndexShadowed(t *testing.T) {
+	// VAV is a subclass of Damper here, so it can never be matched
+	_, err := newClassIndex(staticClasses{
+		"Damper": {"Damper", "VAV"},
+		"VAV":    {"VAV"},
+		"Sensor": {"Sensor"},
+	}, testTaxonomy)
+	if err == nil {
+		t.Error("Expected an error for a shadowed class")
+	}
+}
+
+func TestClassIndexReload(t *testing.T) {
+	source := staticClasses{"Damper": {"Damper"}, "VAV": {"VAV"}, "Sensor": {"Sensor"}}
+	idx, err := newClassIndex(source, testTaxonomy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := idx.load(); err != nil || changed {
+		t.Errorf("Reloading the same classes: changed %v, error %v", changed, err)
+	}
+	source["Sensor"] = []string{"Sensor", "Zone_Temperature_Sensor"}
+	if changed, err := idx.load(); err != nil || !changed {
+		t.Errorf("Reloading new classes: changed %v, error %v", changed, err)
+	}
+	if generic := idx.classify("Zone_Temperature_Sensor"); generic == nil || generic.Class != "Sensor" {
+		t.Errorf("New subclass classified as %+v", generic)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// how a source maps its sMAP UUIDs to Brick points
+const (
+	// look up the point and equipment of each UUID with the server's
+	// resolvers (just Hod unless --resolvers says otherwise)
+	resolveHod = "hod"
+	// don't resolve anything; publish on the sMAP path
+	resolvePath = "path"
+)
+
+// a sMAP source as described in the config file
+type sourceConfig struct {
+	// used in the report URL: /add/<name>
+	Name string `yaml:"name"`
+	// entity file the source publishes with
+	Entity string `yaml:"entity"`
+	// prefix for all URIs the source publishes on
+	BaseURI string `yaml:"baseuri"`
+	// how to form the URI for each timeseries; depends on the resolution if empty
+	URITemplate string `yaml:"uritemplate"`
+	// how to form the URI for timeseries that can't be resolved; uses the
+	// server's if empty, and "none" publishes nothing for them
+	FallbackTemplate string `yaml:"fallbacktemplate"`
+	// PO number (dot form) for numeric readings; depends on batching if empty
+	PONum string `yaml:"ponum"`
+	// unit of time for published timestamps; uses the server's if empty
+	TimeUnit string `yaml:"timeunit"`
+	// one of "hod" (default) or "path"
+	Resolution string `yaml:"resolution"`
+	// publish all readings of a message as one BatchMessage
+	Batch bool `yaml:"batch"`
+	// the driver's sMAP data resource, e.g. http://localhost:8080/data; if
+	// set, writes to the slots of actuatable points are forwarded to it
+	ActuatorURL string `yaml:"actuatorurl"`
+}
+
+type configFile struct {
+	Sources []sourceConfig `yaml:"sources"`
+}
+
+// a source that is ready to publish
+type source struct {
+	name       string
+	vk         string
+	entity     string
+	baseuri    string
+	template   string
+	ponum      string
+	timeUnit   UnitOfTime
+	resolution string
+	batch      bool
+	// URI template for unresolved timeseries; empty if we drop them
+	fallback string
+	// where actuation requests are sent; empty if we don't actuate
+	actuatorURL string
+}
+
+// loads and validates the config file. Does not load any entities
+func loadConfig(filename string, defaults serverConfig) (map[string]*source, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read config file %s", filename)
+	}
+	var file configFile
+	if err := yaml.UnmarshalStrict(contents, &file); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse config file %s", filename)
+	}
+	var sources = make(map[string]*source)
+	for _, sc := range file.Sources {
+		src, err := sc.toSource(defaults)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid config file %s", filename)
+		}
+		if _, found := sources[src.name]; found {
+			return nil, fmt.Errorf("Invalid config file %s: source %s is listed more than once", filename, src.name)
+		}
+		sources[src.name] = src
+	}
+	return sources, nil
+}
+
+func (sc sourceConfig) toSource(defaults serverConfig) (*source, error) {
+	var err error
+	if sc.Name == "" {
+		return nil, errors.New("Source has no name")
+	}
+	if strings.ContainsAny(sc.Name, "/?#% \t") {
+		return nil, fmt.Errorf("Source name %q cannot be used in a URL", sc.Name)
+	}
+	if sc.Entity == "" {
+		return nil, fmt.Errorf("Source %s has no entity file", sc.Name)
+	}
+	if sc.BaseURI == "" {
+		return nil, fmt.Errorf("Source %s has no base URI", sc.Name)
+	}
+	src := &source{
+		name:       sc.Name,
+		entity:     sc.Entity,
+		baseuri:    strings.Trim(sc.BaseURI, "/"),
+		template:   sc.URITemplate,
+		fallback:   defaults.fallbackTemplate,
+		ponum:      sc.PONum,
+		timeUnit:   defaults.timeUnit,
+		resolution: sc.Resolution,
+		batch:      sc.Batch || defaults.batch,
+		// no trailing slash, since the sMAP path starts with one
+		actuatorURL: strings.TrimRight(sc.ActuatorURL, "/"),
+	}
+	switch src.resolution {
+	case "", resolveHod:
+		src.resolution = resolveHod
+		if src.template == "" {
+			src.template = brickTemplate
+		}
+	case resolvePath:
+		if src.template == "" {
+			src.template = pathTemplate
+		}
+	default:
+		return nil, fmt.Errorf("Source %s has unknown resolution %q (must be %s or %s)", sc.Name, sc.Resolution, resolveHod, resolvePath)
+	}
+	if err = checkURI(src.baseuri); err != nil {
+		return nil, errors.Wrapf(err, "Source %s has invalid base URI", sc.Name)
+	}
+	if err = checkTemplate(src.template, src.resolution == resolveHod); err != nil {
+		return nil, errors.Wrapf(err, "Source %s", sc.Name)
+	}
+	switch sc.FallbackTemplate {
+	case "":
+	case noFallback:
+		src.fallback = ""
+	default:
+		src.fallback = sc.FallbackTemplate
+		if err = checkTemplate(src.fallback, false); err != nil {
+			return nil, errors.Wrapf(err, "Source %s", sc.Name)
+		}
+	}
+	if sc.TimeUnit != "" {
+		if src.timeUnit, err = ParseUOT(sc.TimeUnit); err != nil {
+			return nil, errors.Wrapf(err, "Source %s", sc.Name)
+		}
+	}
+	if src.actuatorURL != "" {
+		if u, err := url.Parse(src.actuatorURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("Source %s has invalid actuator URL %s (must be http or https)", sc.Name, sc.ActuatorURL)
+		}
+	}
+	if src.ponum != "" && len(strings.Split(src.ponum, ".")) != 4 {
+		return nil, fmt.Errorf("Source %s has invalid PO number %s (must be in dot form a.b.c.d)", sc.Name, src.ponum)
+	}
+	return src, nil
+}
+
+// returns the source for the given name
+func (s *server) getSource(name string) *source {
+	s.sourcesLock.RLock()
+	defer s.sourcesLock.RUnlock()
+	return s.sources[name]
+}
+
+// Loads the config file and the entities of all sources in it, then swaps
+// in the new sources and unloads the entities that no source uses anymore.
+// Every entity file is loaded again, so that edited files and entities that
+// were removed through the admin socket take effect. On error, the current
+// sources are kept
+func (s *server) loadSources() error {
+	sources, err := loadConfig(s.cfg.configFile, s.cfg)
+	if err != nil {
+		return err
+	}
+	s.sourcesLock.RLock()
+	inUse := make(map[string]bool)
+	for _, src := range s.sources {
+		inUse[src.vk] = true
+	}
+	s.sourcesLock.RUnlock()
+
+	used := make(map[string]bool)
+	for _, src := range sources {
+		if src.vk, err = s.store.loadEntityFile(src.entity); err != nil {
+			// the current sources stay, so neither should the entities
+			// that only the new ones would have used
+			for vk := range used {
+				if !inUse[vk] {
+					s.store.unloadEntity(vk)
+				}
+			}
+			return errors.Wrapf(err, "Could not load entity for source %s", src.name)
+		}
+		used[src.vk] = true
+	}
+	s.sourcesLock.Lock()
+	previous := s.sources
+	s.sources = sources
+	s.sourcesLock.Unlock()
+	for _, prev := range previous {
+		if !used[prev.vk] {
+			s.store.unloadEntity(prev.vk)
+			used[prev.vk] = true
+		}
+	}
+	log.Noticef("Loaded %d sources from %s", len(sources), s.cfg.configFile)
+	return nil
+}
+
+// reloads the config file whenever we get a SIGHUP
+func (s *server) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for _ = range c {
+			log.Notice("Got SIGHUP; reloading config")
+			if err := s.loadSources(); err != nil {
+				log.Error(errors.Wrap(err, "Could not reload config"))
+			}
+		}
+	}()
+}
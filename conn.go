@@ -0,0 +1,254 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// returned (possibly wrapped) when we can't talk to the local BW2 agent
+var errAgentUnavailable = errors.New("BW2 agent unavailable")
+
+// bounds for the delay between attempts to reconnect to the agent
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 1 * time.Minute
+)
+
+// Shares a fixed pool of agent connections among all entities. A bw2 client
+// acts as one entity at a time, so each connection remembers which entity it
+// has set and switches entities only when it is handed to a different one.
+// With at least as many connections as active entities, no switching happens.
+// Connections are made lazily and remade with backoff if the agent goes away
+type connManager struct {
+	agent string
+	conns []*agentConn
+	// vk -> entity contents (without the leading type byte)
+	entities map[string][]byte
+	// vk -> last error we got setting the entity; nil if it worked
+	failures map[string]error
+	sync.Mutex
+}
+
+type agentConn struct {
+	// which entity the connection was last handed to, and when; guarded by
+	// the connManager's lock rather than the connection's
+	owner  string
+	picked time.Time
+
+	// the rest is guarded by the connection's lock
+	client *bw2.BW2Client
+	// vk of the entity currently set on the client
+	vk string
+	// when we can next try to connect, and how long to wait after that
+	retryAt time.Time
+	delay   time.Duration
+	sync.Mutex
+}
+
+func newConnManager(agent string, size int) *connManager {
+	if size < 1 {
+		size = 1
+	}
+	m := &connManager{
+		agent:    agent,
+		entities: make(map[string][]byte),
+		failures: make(map[string]error),
+	}
+	for i := 0; i < size; i++ {
+		m.conns = append(m.conns, &agentConn{delay: minReconnectDelay})
+	}
+	return m
+}
+
+// makes the entity available to do(). Does not connect to the agent
+func (m *connManager) addEntity(vk string, contents []byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.entities[vk] = contents
+	delete(m.failures, vk)
+}
+
+func (m *connManager) removeEntity(vk string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entities, vk)
+	delete(m.failures, vk)
+}
+
+// returns the contents of the entity, if it has been added
+func (m *connManager) entity(vk string) ([]byte, bool) {
+	m.Lock()
+	defer m.Unlock()
+	contents, found := m.entities[vk]
+	return contents, found
+}
+
+// returns true if the entity has been added
+func (m *connManager) has(vk string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, found := m.entities[vk]
+	return found
+}
+
+// returns the last error we got using the entity, or nil if it worked
+func (m *connManager) failure(vk string) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.failures[vk]
+}
+
+// Calls f with a client that has the given entity set. The client must not be
+// used after f returns. Errors from the agent connection are reported as
+// errAgentUnavailable so the caller can tell them apart from errors in f
+func (m *connManager) do(vk string, f func(client *bw2.BW2Client) error) error {
+	m.Lock()
+	contents, found := m.entities[vk]
+	if !found {
+		m.Unlock()
+		return errUnknownVK
+	}
+	conn := m.pick(vk)
+	m.Unlock()
+
+	conn.Lock()
+	defer conn.Unlock()
+	if err := conn.connect(m.agent); err != nil {
+		return err
+	}
+	if conn.vk != vk {
+		vk2, err := conn.client.SetEntity(contents)
+		if err == nil && vk2 != vk {
+			err = errors.Errorf("Retrieved vk %s did not match vk from router %s", vk, vk2)
+		}
+		if err != nil {
+			conn.vk = ""
+			if !reachable(conn.client) {
+				conn.disconnect()
+				return errors.Wrap(errAgentUnavailable, err.Error())
+			}
+			err = errors.Wrap(err, "Could not set entity")
+			m.fail(vk, err)
+			return err
+		}
+		conn.vk = vk
+	}
+
+	err := f(conn.client)
+	if err != nil && !reachable(conn.client) {
+		conn.disconnect()
+		return errors.Wrap(errAgentUnavailable, err.Error())
+	}
+	m.fail(vk, nil)
+	return err
+}
+
+// returns the connection that was last handed to the entity, or else the
+// least recently used one, and hands it to the entity. Must be called with
+// the lock held
+func (m *connManager) pick(vk string) *agentConn {
+	var conn *agentConn
+	for _, c := range m.conns {
+		if c.owner == vk {
+			conn = c
+			break
+		}
+		if conn == nil || c.picked.Before(conn.picked) {
+			conn = c
+		}
+	}
+	conn.owner = vk
+	conn.picked = time.Now()
+	return conn
+}
+
+// Checks that the agent answers on the least recently used connection,
+// connecting it first if needed
+func (m *connManager) probe() error {
+	m.Lock()
+	conn := m.conns[0]
+	for _, c := range m.conns[1:] {
+		if c.picked.Before(conn.picked) {
+			conn = c
+		}
+	}
+	m.Unlock()
+
+	conn.Lock()
+	defer conn.Unlock()
+	if err := conn.connect(m.agent); err != nil {
+		return err
+	}
+	if !reachable(conn.client) {
+		conn.disconnect()
+		return errors.Wrapf(errAgentUnavailable, "Could not reach agent %s", m.agent)
+	}
+	return nil
+}
+
+// returns the number of entities, and the last error for each entity the
+// agent rejected
+func (m *connManager) entityStatus() (int, map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+	var failed = make(map[string]string)
+	for vk, err := range m.failures {
+		if err != nil {
+			failed[vk] = err.Error()
+		}
+	}
+	return len(m.entities), failed
+}
+
+func (m *connManager) fail(vk string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err != nil && m.failures[vk] == nil {
+		log.Errorf("Entity %s: %s", vk, err)
+	}
+	if _, found := m.entities[vk]; found {
+		m.failures[vk] = err
+	}
+}
+
+// connects to the agent if we aren't already, unless we are still backing
+// off from a failed attempt. Must be called with the connection's lock held
+func (conn *agentConn) connect(agent string) error {
+	if conn.client != nil {
+		return nil
+	}
+	if time.Now().Before(conn.retryAt) {
+		return errAgentUnavailable
+	}
+	client, err := bw2.Connect(agent)
+	if err != nil {
+		conn.retryAt = time.Now().Add(conn.delay)
+		log.Warningf("Could not connect to agent %s (retrying in %s): %s", agent, conn.delay, err)
+		if conn.delay *= 2; conn.delay > maxReconnectDelay {
+			conn.delay = maxReconnectDelay
+		}
+		return errors.Wrap(errAgentUnavailable, err.Error())
+	}
+	conn.client = client
+	conn.delay = minReconnectDelay
+	return nil
+}
+
+// closes the client so we reconnect on next use
+func (conn *agentConn) disconnect() {
+	if err := conn.client.Disconnect(); err != nil {
+		log.Debugf("Could not close agent connection: %s", err)
+	}
+	conn.client = nil
+	conn.vk = ""
+	conn.retryAt = time.Now().Add(conn.delay)
+}
+
+// returns true if the client can talk to its router
+func reachable(client *bw2.BW2Client) bool {
+	_, err := client.GetBCInteractionParams()
+	return err == nil
+}
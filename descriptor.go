@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// PO number of the InterfaceDescriptor persisted for each equipment interface
+const interfaceDescriptorPO = "2.0.9.6"
+
+// a signal in an InterfaceDescriptor
+type SignalDescriptor struct {
+	Name string
+	URI  string
+	// the Brick name of the point
+	Point string
+	Class string
+	UUID  string
+}
+
+// a slot in an InterfaceDescriptor
+type SlotDescriptor struct {
+	Name string
+	URI  string
+	// the sMAP path of the point, which is what the driver actuates
+	Path string
+	// the sMAP actuator model: binary, discrete or continuous
+	Model string
+}
+
+// Lists the signals and slots of an equipment interface. Persisted on
+// <interface URI>/descriptor whenever it changes
+type InterfaceDescriptor struct {
+	URI            string
+	Equipment      string
+	EquipmentClass string
+	Interface      string
+	Signals        []SignalDescriptor
+	Slots          []SlotDescriptor
+}
+
+type interfaceEntry struct {
+	vk         string
+	descriptor InterfaceDescriptor
+	// bumped on every change
+	version   int
+	published int
+}
+
+// returns a copy of the descriptor that is safe to use without the lock
+func (entry *interfaceEntry) copy() InterfaceDescriptor {
+	desc := entry.descriptor
+	desc.Signals = append([]SignalDescriptor{}, desc.Signals...)
+	desc.Slots = append([]SlotDescriptor{}, desc.Slots...)
+	return desc
+}
+
+// collects the signals and slots of each equipment interface as points are
+// published
+type interfaceRegistry struct {
+	// interface uri -> entry
+	interfaces map[string]*interfaceEntry
+	sync.Mutex
+}
+
+func newInterfaceRegistry() *interfaceRegistry {
+	return &interfaceRegistry{
+		interfaces: make(map[string]*interfaceEntry),
+	}
+}
+
+// records the signal (and slot, if the point has one) of a point on the
+// interface, bumping the version if the descriptor changed
+func (r *interfaceRegistry) update(vk, iface string, info *pointInfo, signal SignalDescriptor, slot *SlotDescriptor) {
+	r.Lock()
+	defer r.Unlock()
+	entry, found := r.interfaces[iface]
+	if !found {
+		entry = &interfaceEntry{descriptor: InterfaceDescriptor{URI: iface}}
+		r.interfaces[iface] = entry
+	}
+	desc := &entry.descriptor
+	changed := !found || entry.vk != vk ||
+		desc.Equipment != info.Equipment ||
+		desc.EquipmentClass != info.EquipmentClass ||
+		desc.Interface != info.EquipInterface
+	entry.vk = vk
+	desc.Equipment = info.Equipment
+	desc.EquipmentClass = info.EquipmentClass
+	desc.Interface = info.EquipInterface
+
+	changed = setSignal(&desc.Signals, signal) || changed
+	if slot != nil {
+		changed = setSlot(&desc.Slots, *slot) || changed
+	}
+	if changed {
+		entry.version += 1
+	}
+}
+
+// adds or replaces the signal of the same point. Returns true if anything changed
+func setSignal(signals *[]SignalDescriptor, signal SignalDescriptor) bool {
+	for i, existing := range *signals {
+		if existing.Point == signal.Point {
+			(*signals)[i] = signal
+			return existing != signal
+		}
+	}
+	*signals = append(*signals, signal)
+	sort.Slice(*signals, func(i, j int) bool { return (*signals)[i].Name < (*signals)[j].Name })
+	return true
+}
+
+// adds or replaces the slot of the same point. Returns true if anything changed
+func setSlot(slots *[]SlotDescriptor, slot SlotDescriptor) bool {
+	for i, existing := range *slots {
+		if existing.Path == slot.Path {
+			(*slots)[i] = slot
+			return existing != slot
+		}
+	}
+	*slots = append(*slots, slot)
+	sort.Slice(*slots, func(i, j int) bool { return (*slots)[i].Name < (*slots)[j].Name })
+	return true
+}
+
+// a descriptor that hasn't been published since it last changed
+type pendingDescriptor struct {
+	vk         string
+	version    int
+	descriptor InterfaceDescriptor
+}
+
+// returns copies of the descriptors that changed since they were last published
+func (r *interfaceRegistry) pending() []pendingDescriptor {
+	r.Lock()
+	defer r.Unlock()
+	var pending []pendingDescriptor
+	for _, entry := range r.interfaces {
+		if entry.published == entry.version {
+			continue
+		}
+		pending = append(pending, pendingDescriptor{vk: entry.vk, version: entry.version, descriptor: entry.copy()})
+	}
+	return pending
+}
+
+// records that the given version of the descriptor was published
+func (r *interfaceRegistry) markPublished(iface string, version int) {
+	r.Lock()
+	defer r.Unlock()
+	if entry, found := r.interfaces[iface]; found && entry.published < version {
+		entry.published = version
+	}
+}
+
+// returns all descriptors, sorted by URI
+func (r *interfaceRegistry) list() []InterfaceDescriptor {
+	r.Lock()
+	defer r.Unlock()
+	var descriptors = make([]InterfaceDescriptor, 0, len(r.interfaces))
+	for _, entry := range r.interfaces {
+		descriptors = append(descriptors, entry.copy())
+	}
+	sort.Slice(descriptors, func(i, j int) bool {
+		return descriptors[i].URI < descriptors[j].URI
+	})
+	return descriptors
+}
+
+// Records the signal and slot of a published point on its interface, and
+// persists the descriptors that changed. Like metadata, this is best effort;
+// descriptors that fail to publish are retried with the next message
+func (s *server) describe(src *source, msg SmapMessage, info *pointInfo, uri, signal string) {
+	iface := interfaceURI(uri)
+	// slots are named like signals, except when every point shares signal/info
+	slotName := signal
+	if signal == "info" {
+		slotName = signalSegment(localName(info.Name))
+	}
+	slot, err := s.actuators.register(src, msg, iface, slotName)
+	if err != nil {
+		log.Error(err)
+	}
+	// only Brick points belong to an equipment interface
+	if info.Equipment == "" {
+		return
+	}
+	s.interfaces.update(src.vk, iface, info, SignalDescriptor{
+		Name:  signal,
+		URI:   uri,
+		Point: info.Name,
+		Class: info.Class,
+		UUID:  msg.UUID,
+	}, slot)
+	for _, pending := range s.interfaces.pending() {
+		if err := s.publishDescriptor(pending); err != nil {
+			log.Error(err)
+			continue
+		}
+		s.interfaces.markPublished(pending.descriptor.URI, pending.version)
+	}
+}
+
+func (s *server) publishDescriptor(pending pendingDescriptor) error {
+	uri := pending.descriptor.URI + "/descriptor"
+	po, err := bw2.CreateMsgPackPayloadObject(bw2.FromDotForm(interfaceDescriptorPO), pending.descriptor)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode interface descriptor")
+	}
+	if err := s.publisher.Persist(pending.vk, uri, po); err != nil {
+		return errors.Wrapf(err, "Could not publish interface descriptor on %s", uri)
+	}
+	return nil
+}
+
+// lists the descriptors of the equipment interfaces we have published on
+func (s *server) listInterfaces(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.interfaces.list())
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+)
+
+// how often we check entities for upcoming expiry
+const expiryCheckInterval = 1 * time.Hour
+
+// logs a warning for every entity, registered or loaded from a config source,
+// that expires within the given window and updates the expiry metrics. Runs
+// forever
+func (s *server) watchExpiry(window time.Duration) {
+	s.checkExpiry(window)
+	for _ = range time.Tick(expiryCheckInterval) {
+		s.checkExpiry(window)
+	}
+}
+
+func (s *server) checkExpiry(window time.Duration) {
+	infos, err := s.store.listEntities()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	var expiring int
+	entityExpirySeconds.Reset()
+	for _, info := range infos {
+		if info.Expires == nil {
+			continue
+		}
+		left := info.Expires.Sub(time.Now())
+		if left > window {
+			continue
+		}
+		expiring += 1
+		entityExpirySeconds.WithLabelValues(info.VK).Set(left.Seconds())
+		if left <= 0 {
+			log.Errorf("Entity %s (%s) expired on %s", info.VK, info.Contact, info.Expires.Format(time.RFC3339))
+		} else {
+			log.Warningf("Entity %s (%s) expires on %s", info.VK, info.Contact, info.Expires.Format(time.RFC3339))
+		}
+	}
+	entitiesExpiring.Set(float64(expiring))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long we wait for Hod to answer the readiness probe
+const hodProbeTimeout = 5 * time.Second
+
+// how long we wait for the agent to answer a health check
+const agentProbeTimeout = 5 * time.Second
+
+// the result of one health check
+type checkResult struct {
+	OK    bool
+	Error string `json:",omitempty"`
+}
+
+func check(err error) checkResult {
+	if err != nil {
+		return checkResult{OK: false, Error: err.Error()}
+	}
+	return checkResult{OK: true}
+}
+
+type entityHealth struct {
+	Loaded int
+	// vk -> why the agent rejected it
+	Failed map[string]string `json:",omitempty"`
+}
+
+type queueHealth struct {
+	Size    int
+	MaxSize int
+	// true while messages are being buffered instead of published
+	Buffering bool
+}
+
+// returned by /healthz and /readyz
+type healthReport struct {
+	// "ok" or "degraded"
+	Status string
+	Agent  checkResult
+	// only checked by /readyz, and only if we use Hod
+	Hod         *checkResult `json:",omitempty"`
+	LastPublish *time.Time   `json:",omitempty"`
+	Entities    entityHealth
+	Queue       queueHealth
+}
+
+// Reports on the agent connection, entities and outbound queue. Replies with
+// 503 if the agent is unreachable, an entity was rejected, or the queue is
+// buffering
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, s.health(false))
+}
+
+// like /healthz, but also checks that Hod answers queries
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, s.health(true))
+}
+
+func (s *server) writeHealth(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(503)
+	}
+	writeJSON(w, report)
+}
+
+func (s *server) health(probeHod bool) healthReport {
+	var report healthReport
+
+	// ask the agent rather than going by the last publish, which may have
+	// been a while ago
+	agentErr := withTimeout("Agent "+s.store.agent, agentProbeTimeout, s.store.conns.probe)
+	if agentErr == nil && s.hod != nil {
+		agentErr = withTimeout("Agent "+s.store.agent, agentProbeTimeout, s.hod.ping)
+	}
+	report.Agent = check(agentErr)
+
+	if probeHod && s.hod != nil {
+		hod := check(s.probeHod())
+		report.Hod = &hod
+	}
+
+	report.Entities.Loaded, report.Entities.Failed = s.store.conns.entityStatus()
+
+	size, buffering, lastPublished := s.queue.status()
+	report.Queue = queueHealth{Size: size, MaxSize: s.queue.maxSize, Buffering: buffering}
+	if !lastPublished.IsZero() {
+		report.LastPublish = &lastPublished
+	}
+
+	report.Status = "ok"
+	if !report.Agent.OK || (report.Hod != nil && !report.Hod.OK) || len(report.Entities.Failed) > 0 || buffering {
+		report.Status = "degraded"
+	}
+	return report
+}
+
+// runs a trivial query against Hod, giving up after hodProbeTimeout
+func (s *server) probeHod() error {
+	return withTimeout("Hod", hodProbeTimeout, func() error {
+		_, err := s.hod.DoQuery(`SELECT ?class WHERE { ?class rdfs:subClassOf brick:Point . };`, nil)
+		return err
+	})
+}
+
+// runs the check, giving up on it after the timeout. A check that hangs is
+// left running in the background
+func withTimeout(what string, timeout time.Duration, check func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.Errorf("%s did not answer within %s", what, timeout)
+	}
+}
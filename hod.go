@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	hod "github.com/gtfierro/hod/clients/go"
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// The Hod client and the agent connection it queries through, which uses the
+// server's own entity. Like the connections in the pool, it is dropped when
+// the agent goes away and reconnected with backoff on next use
+type hodConn struct {
+	agent  string
+	entity string
+	uri    string
+	client *bw2.BW2Client
+	hod    *hod.HodClientBW2
+	// don't try to reconnect before this
+	retryAt time.Time
+	delay   time.Duration
+	sync.Mutex
+}
+
+// Connects to Hod, waiting with backoff until the agent is available. Other
+// errors, like an entity the agent rejects, are returned
+func newHodConn(agent, entity, uri string) (*hodConn, error) {
+	c := &hodConn{agent: agent, entity: entity, uri: uri, delay: minReconnectDelay}
+	delay := minReconnectDelay
+	for {
+		client, hc, err := c.dial()
+		if err == nil {
+			c.client, c.hod = client, hc
+			return c, nil
+		}
+		if errors.Cause(err) != errAgentUnavailable {
+			return nil, err
+		}
+		log.Warningf("Could not connect to agent %s (retrying in %s): %s", agent, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// makes a new agent connection and Hod client
+func (c *hodConn) dial() (*bw2.BW2Client, *hod.HodClientBW2, error) {
+	client, err := bw2.Connect(c.agent)
+	if err != nil {
+		return nil, nil, errors.Wrap(errAgentUnavailable, err.Error())
+	}
+	client.OverrideAutoChainTo(true)
+	if _, err := client.SetEntityFile(c.entity); err != nil {
+		client.Disconnect()
+		return nil, nil, errors.Wrapf(err, "Could not set entity %s", c.entity)
+	}
+	hc, err := hod.NewBW2Client(client, c.uri)
+	if err != nil {
+		client.Disconnect()
+		return nil, nil, errors.Wrapf(err, "Could not connect to Hod at %s", c.uri)
+	}
+	return client, hc, nil
+}
+
+// returns the current Hod client, reconnecting if the last one was dropped
+// and we aren't backing off
+func (c *hodConn) get() (*bw2.BW2Client, *hod.HodClientBW2, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.hod != nil {
+		return c.client, c.hod, nil
+	}
+	if time.Now().Before(c.retryAt) {
+		return nil, nil, errAgentUnavailable
+	}
+	client, hc, err := c.dial()
+	if err != nil {
+		c.retryAt = time.Now().Add(c.delay)
+		log.Warningf("Could not reconnect to Hod (retrying in %s): %s", c.delay, err)
+		if c.delay *= 2; c.delay > maxReconnectDelay {
+			c.delay = maxReconnectDelay
+		}
+		return nil, nil, err
+	}
+	log.Noticef("Reconnected to Hod at %s", c.uri)
+	c.client, c.hod = client, hc
+	c.delay = minReconnectDelay
+	return client, hc, nil
+}
+
+// drops the client if it is still the current one, so we reconnect on next use
+func (c *hodConn) drop(client *bw2.BW2Client) {
+	c.Lock()
+	defer c.Unlock()
+	if c.client != client {
+		return
+	}
+	if err := client.Disconnect(); err != nil {
+		log.Debugf("Could not close agent connection: %s", err)
+	}
+	c.client, c.hod = nil, nil
+	c.retryAt = time.Now().Add(c.delay)
+}
+
+// Runs the query against Hod. If it fails because the agent is unreachable,
+// the connection is dropped and the error is errAgentUnavailable
+func (c *hodConn) DoQuery(query string, options *hod.QueryOptions) (*hod.QueryResult, error) {
+	client, hc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	res, err := hc.DoQuery(query, options)
+	if err != nil && !reachable(client) {
+		c.drop(client)
+		return nil, errors.Wrap(errAgentUnavailable, err.Error())
+	}
+	return res, err
+}
+
+// Checks that the agent answers on the Hod client's connection, reconnecting
+// first if it was dropped
+func (c *hodConn) ping() error {
+	client, _, err := c.get()
+	if err != nil {
+		return err
+	}
+	if !reachable(client) {
+		c.drop(client)
+		return errors.Wrapf(errAgentUnavailable, "Could not reach agent %s", c.agent)
+	}
+	return nil
+}
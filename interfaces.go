@@ -1,13 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-var classes = []string{"Damper", "VAV", "Sensor", "Command", "Setpoint", "Status"}
+// returned for timeseries none of the resolvers knew about when the source
+// has no fallback URI
+var errUnresolved = errors.New("UUID could not be resolved and there is no fallback template")
 
 type Damper struct {
 	Name     string
@@ -30,93 +31,134 @@ type Writeable interface {
 //        ?equip rdf:type ?equipclass .
 //    };`, msg.UUID)
 
-func (s *server) forward(uuid string, data [][]json.Number, baseuri string) error {
-
-	query := fmt.Sprintf(`SELECT ?name ?class ?equip ?equipclass WHERE {
-            ?name bf:uuid "%s" .
-            ?name rdf:type ?class .
-            {
-                ?name bf:isPointOf ?equip .
-                OR
-                ?name bf:isPartOf ?equip .
-            }
-            ?equip rdf:type ?equipclass .
-        };`, uuid)
-	res, err := s.hod.DoQuery(query, nil)
-	if err != nil {
-		return err
-	}
-	if len(res.Rows) == 0 {
-		return errors.New("No results")
-	}
-
-	row := res.Rows[0]
-	point_class := row["?class"].Value
-	equipment_class := row["?equipclass"].Value
-	equipment_name := row["?equip"].Value
-	log.Debug(point_class, equipment_class)
-
-	// the publish/interface URI is constructed as
-	// baseuri + s.bms + equipment name + i.equipment type + signal + info
-
-	var generic_point_class, generic_equip_class string
-
-	for _, superclass := range classes {
-		if f, err := s.isSubclassOf(point_class, superclass); err != nil {
-			return err
-		} else if f {
-			log.Debugf("%s is subclass of %s", point_class, superclass)
-			generic_point_class = superclass
-			break
+// resolves and publishes one timeseries, returning what happened to it. The
+// status is filled in even if there is an error
+func (s *server) forward(src *source, msg SmapMessage) (pathStatus, error) {
+
+	var info *pointInfo
+	if src.resolution == resolvePath {
+		info = &pointInfo{Name: msg.Path}
+	} else if cached, found := s.cache.get(msg.UUID); found {
+		cacheLookups.WithLabelValues("hit").Inc()
+		info = cached
+	} else {
+		cacheLookups.WithLabelValues("miss").Inc()
+		var err error
+		if info, err = s.resolver.Resolve(msg); err != nil {
+			errorsTotal.WithLabelValues(errorResolve).Inc()
+			return pathStatus{Status: statusRejected}, err
+		}
+		if info != nil {
+			s.classify(info)
 		}
+		s.cache.put(msg.UUID, info)
 	}
-
-	for _, superclass := range classes {
-		if f, err := s.isSubclassOf(equipment_class, superclass); err != nil {
-			return err
-		} else if f {
-			log.Debugf("%s is subclass of %s", equipment_class, superclass)
-			generic_equip_class = superclass
-			break
+	if info == nil {
+		s.unresolved.add(src, msg)
+		errorsTotal.WithLabelValues(errorUnresolved).Inc()
+		// with no fallback, the driver needs to know its readings went nowhere
+		if src.fallback == "" {
+			return pathStatus{Status: statusRejected}, errUnresolved
 		}
+		return s.forwardUnresolved(src, msg)
 	}
+	s.unresolved.remove(msg.UUID)
 
-	uri := fmt.Sprintf("%s/s.bms/%s/i.%s/signal/info", baseuri, equipment_name, generic_equip_class)
-	err = s.publish(SmapParams{
-		Data:           data,
+	// the publish/interface URI is formed from the source's template, by default
+	// baseuri + s.bms + equipment name + i.equipment interface + signal + the
+	// point's signal name
+	signal := s.signals.name(src.baseuri+"/"+info.Equipment, info)
+	uri, err := expandTemplate(src.template, templateValues(src, msg, info, signal), msg.Metadata)
+	if err != nil {
+		errorsTotal.WithLabelValues(errorTemplate).Inc()
+		return pathStatus{Status: statusRejected}, err
+	}
+	// metadata is best effort; we will try again with the next message
+	if err := s.persistMetadata(src.vk, s.metadataURI(src.template, uri, msg), msg, info); err != nil {
+		errorsTotal.WithLabelValues(errorMetadata).Inc()
+		log.Error(err)
+	}
+	start := time.Now()
+	buffered, err := s.publish(src, SmapParams{
+		Data:           msg.Readings,
+		UnitOfTime:     msg.UnitOfTime(),
+		StreamType:     msg.StreamType(),
 		URI:            uri,
-		Name:           row["?name"].Value,
-		Class:          generic_point_class,
-		Equipment:      equipment_name,
-		EquipmentClass: generic_equip_class,
+		Name:           info.Name,
+		Class:          info.GenericClass,
+		Equipment:      info.Equipment,
+		EquipmentClass: info.GenericEquipClass,
 	})
-
-	if err != nil {
-		return err
+	observePublish(src, start, err)
+	if err == nil {
+		s.describe(src, msg, info, uri, signal)
 	}
-
-	return nil
+	return publishStatus(statusPublished, uri, buffered, err), err
 }
 
-func (s *server) isSubclassOf(subclass, superclass string) (bool, error) {
+// fills in the generic classes and the equipment interface of the point
+func (s *server) classify(info *pointInfo) {
+	if generic := s.classes.classify(info.Class); generic != nil {
+		log.Debugf("%s is subclass of %s", info.Class, generic.Class)
+		info.GenericClass = generic.Class
+	}
+	if generic := s.classes.classify(info.EquipmentClass); generic != nil {
+		log.Debugf("%s is subclass of %s", info.EquipmentClass, generic.Class)
+		info.GenericEquipClass = generic.Class
+		info.EquipInterface = generic.Interface
+	}
+}
 
-	query := fmt.Sprintf(`SELECT ?class WHERE {
-            ?class rdfs:subClassOf* brick:%s .
-        };`, superclass)
-	res, err := s.hod.DoQuery(query, nil)
+// publishes the timeseries of a UUID we couldn't resolve on the source's
+// fallback URI, along with its sMAP metadata
+func (s *server) forwardUnresolved(src *source, msg SmapMessage) (pathStatus, error) {
+	uri, err := expandTemplate(src.fallback, templateValues(src, msg, &pointInfo{Name: msg.Path}, ""), msg.Metadata)
 	if err != nil {
-		return false, err
+		errorsTotal.WithLabelValues(errorTemplate).Inc()
+		return pathStatus{Status: statusRejected}, err
 	}
-	if len(res.Rows) == 0 {
-		return false, errors.New("No results")
+	if err := s.persistMetadata(src.vk, s.metadataURI(src.fallback, uri, msg), msg, &pointInfo{Name: msg.Path}); err != nil {
+		errorsTotal.WithLabelValues(errorMetadata).Inc()
+		log.Error(err)
 	}
+	start := time.Now()
+	buffered, err := s.publishUnresolved(src, uri, msg)
+	observePublish(src, start, err)
+	return publishStatus(statusUnresolved, uri, buffered, err), err
+}
 
-	for _, row := range res.Rows {
-		if row["?class"].Value == subclass {
-			return true, nil
-		}
+// the values of the URI template placeholders for a timeseries. For points
+// that aren't resolved to Brick, the name is the sMAP path
+func templateValues(src *source, msg SmapMessage, info *pointInfo, signal string) map[string]string {
+	return map[string]string{
+		"base":       src.baseuri,
+		"path":       msg.Path,
+		"uuid":       msg.UUID,
+		"name":       info.Name,
+		"equip":      info.Equipment,
+		"equipclass": info.EquipmentClass,
+		"class":      info.Class,
+		"interface":  info.EquipInterface,
+		"signal":     signal,
 	}
+}
 
-	return false, nil
+// records the latency and any error of publishing a timeseries that started at start
+func observePublish(src *source, start time.Time, err error) {
+	publishDuration.WithLabelValues(src.label(), src.baseuri).Observe(time.Since(start).Seconds())
+	if err == errQueueFull {
+		errorsTotal.WithLabelValues(errorQueueFull).Inc()
+	} else if err != nil {
+		errorsTotal.WithLabelValues(errorPublish).Inc()
+	}
+}
 
+// the status of a timeseries we tried to publish on the given URI
+func publishStatus(status, uri string, buffered bool, err error) pathStatus {
+	if err != nil {
+		status = statusRejected
+	} else if buffered && status == statusPublished {
+		status = statusBuffered
+	}
+	return pathStatus{Status: status, URI: uri}
 }
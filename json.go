@@ -1,13 +1,261 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
+type SmapProperties struct {
+	UnitOfTime    UnitOfTime `json:"UnitofTime"`
+	UnitOfMeasure string     `json:"UnitofMeasure"`
+	StreamType    StreamType `json:"StreamType"`
+}
+
 type SmapMessage struct {
 	UUID       string                 `json:"uuid"`
 	Path       string                 `json:"Path"`
-	Properties map[string]interface{} `json:"Properties"`
+	Properties *SmapProperties        `json:"Properties"`
 	Metadata   map[string]interface{} `json:"Metadata"`
-	Readings   [][]json.Number        `json:"Readings"`
+	Readings   []SmapReading          `json:"Readings"`
+	// present if the driver can actuate the timeseries
+	Actuator map[string]interface{} `json:"Actuator"`
+}
+
+// returns true if the message contains anything beyond Path, UUID, Readings
+func (msg *SmapMessage) HasMetadata() bool {
+	return len(msg.Metadata) > 0 ||
+		(msg.Properties != nil && !msg.Properties.IsEmpty())
+}
+
+func (msg *SmapMessage) IsTimeseries() bool {
+	return msg.UUID != ""
+}
+
+func (sp *SmapProperties) IsEmpty() bool {
+	return sp.UnitOfTime == 0 &&
+		sp.UnitOfMeasure == "" &&
+		sp.StreamType == 0
+}
+
+// the body of a sMAP report: a map of paths to the messages at those paths
+type TieredSmapMessage map[string]*SmapMessage
+
+// This performs the metadata inheritance for the paths and messages inside
+// this collection of SmapMessages. Inheritance starts from the root path "/"
+// can progresses towards the leaves.
+// First, get a list of all of the potential timeseries (any path that contains a UUID)
+// Then, for each of the prefixes for the path of that timeserie (getPrefixes), grab
+// the paths from the TieredSmapMessage that match the prefixes. Sort these in "decreasing" order
+// and apply to the metadata.
+// Finally, delete all non-timeseries paths
+func (tsm *TieredSmapMessage) CollapseToTimeseries() {
+	var (
+		prefixMsg *SmapMessage
+		found     bool
+	)
+	// inherit individual keys of nested dictionaries rather than whole dictionaries
+	for path, msg := range *tsm {
+		if msg == nil {
+			delete(*tsm, path)
+			continue
+		}
+		msg.Path = path
+		if len(msg.Metadata) > 0 {
+			msg.Metadata = flatten(msg.Metadata)
+		}
+	}
+	for path, msg := range *tsm {
+		if !msg.IsTimeseries() {
+			continue
+		}
+		prefixes := getPrefixes(path)
+		sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+		for _, prefix := range prefixes {
+			// if we don't find the prefix OR it exists but doesn't have metadata, we skip
+			prefixMsg, found = (*tsm)[prefix]
+			if !found || prefixMsg == nil || !prefixMsg.HasMetadata() {
+				continue
+			}
+			// otherwise, we apply keys from paths higher up if our timeseries doesn't already have the key
+			// (this is reverse inheritance)
+			for k, v := range prefixMsg.Metadata {
+				if _, hasKey := msg.Metadata[k]; !hasKey {
+					if msg.Metadata == nil {
+						msg.Metadata = make(map[string]interface{})
+					}
+					msg.Metadata[k] = v
+				}
+			}
+			if prefixMsg.Properties != nil && !prefixMsg.Properties.IsEmpty() {
+				if msg.Properties == nil {
+					msg.Properties = &SmapProperties{}
+				}
+				if msg.Properties.UnitOfTime == 0 {
+					msg.Properties.UnitOfTime = prefixMsg.Properties.UnitOfTime
+				}
+				if msg.Properties.UnitOfMeasure == "" {
+					msg.Properties.UnitOfMeasure = prefixMsg.Properties.UnitOfMeasure
+				}
+				if msg.Properties.StreamType == 0 {
+					msg.Properties.StreamType = prefixMsg.Properties.StreamType
+				}
+			}
+		}
+	}
+	// when done, delete all non timeseries paths
+	for path, msg := range *tsm {
+		if !msg.IsTimeseries() {
+			delete(*tsm, path)
+		}
+	}
+}
+
+// Given a forward-slash delimited path, returns a slice of prefixes, e.g.:
+// input: /a/b/c/d
+// output: ['/', '/a','/a/b','/a/b/c']
+func getPrefixes(s string) []string {
+	ret := []string{"/"}
+	root := ""
+	s = "/" + s
+	for _, prefix := range strings.Split(s, "/") {
+		if len(prefix) > 0 { //skip empty strings created by Split
+			root += "/" + prefix
+			ret = append(ret, root)
+		}
+	}
+	if len(ret) > 1 {
+		return ret[:len(ret)-1]
+	}
+	return ret
+}
+
+// returns the unit of time declared in the message's Properties,
+// or 0 if the driver didn't tell us
+func (msg SmapMessage) UnitOfTime() UnitOfTime {
+	if msg.Properties == nil {
+		return 0
+	}
+	return msg.Properties.UnitOfTime
+}
+
+// returns the stream type declared in the message's Properties,
+// or 0 if the driver didn't tell us
+func (msg SmapMessage) StreamType() StreamType {
+	if msg.Properties == nil {
+		return 0
+	}
+	return msg.Properties.StreamType
+}
+
+// a single [time, value] pair from a sMAP message. The value is kept as raw
+// JSON until we know whether it belongs to a numeric or an object stream
+type SmapReading struct {
+	Time  json.Number
+	Value json.RawMessage
+}
+
+func (rdg *SmapReading) UnmarshalJSON(b []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("Reading %s is not a [time, value] pair", b)
+	}
+	dec := json.NewDecoder(bytes.NewReader(pair[0]))
+	dec.UseNumber()
+	if err := dec.Decode(&rdg.Time); err != nil {
+		return errors.Wrapf(err, "Invalid timestamp %s", pair[0])
+	}
+	rdg.Value = pair[1]
+	return nil
+}
+
+// returns true if the value is null, which drivers send for missing readings
+func (rdg SmapReading) Null() bool {
+	return bytes.Equal(bytes.TrimSpace(rdg.Value), []byte("null"))
+}
+
+// returns the value of the reading if it is a number
+func (rdg SmapReading) Number() (float64, bool) {
+	// null decodes into a float64 without error, leaving it at 0
+	if rdg.Null() {
+		return 0, false
+	}
+	var value float64
+	if err := json.Unmarshal(rdg.Value, &value); err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// returns the decoded value of the reading, whatever its type
+func (rdg SmapReading) Object() (interface{}, error) {
+	var value interface{}
+	err := json.Unmarshal(rdg.Value, &value)
+	return value, err
+}
+
+// Takes a dictionary that contains nested dictionaries and
+// transforms it to a 1-level map with fields separated by periods k.kk.kkk = v
+func flatten(m map[string]interface{}) map[string]interface{} {
+	var ret = make(map[string]interface{})
+	for k, v := range m {
+		if vb, ok := v.(map[string]interface{}); ok {
+			for kk, vv := range flatten(vb) {
+				ret[k+"."+kk] = vv
+			}
+		} else {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// stream type indicators
+type StreamType uint
+
+const (
+	OBJECT_STREAM StreamType = iota + 1
+	NUMERIC_STREAM
+)
+
+func (st StreamType) String() string {
+	switch st {
+	case OBJECT_STREAM:
+		return "object"
+	case NUMERIC_STREAM:
+		return "numeric"
+	default:
+		return ""
+	}
+}
+
+func (st StreamType) MarshalJSON() ([]byte, error) {
+	switch st {
+	case OBJECT_STREAM:
+		return []byte(`"object"`), nil
+	case NUMERIC_STREAM:
+		return []byte(`"numeric"`), nil
+	default:
+		return []byte(`"numeric"`), nil
+	}
+}
+
+func (st *StreamType) UnmarshalJSON(b []byte) (err error) {
+	str := strings.Trim(string(b), `"`)
+	switch str {
+	case "numeric":
+		*st = NUMERIC_STREAM
+	case "object":
+		*st = OBJECT_STREAM
+	default:
+		return fmt.Errorf("%v is not a valid StreamType", str)
+	}
+	return nil
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSmapReadingValues(t *testing.T) {
+	for _, test := range []struct {
+		reading string
+		number  float64
+		numeric bool
+		null    bool
+	}{
+		{`[1500000000, 72.5]`, 72.5, true, false},
+		{`[1500000000, 0]`, 0, true, false},
+		{`[1500000000, null]`, 0, false, true},
+		{`[1500000000,  null ]`, 0, false, true},
+		{`[1500000000, "on"]`, 0, false, false},
+		{`[1500000000, {"state": 1}]`, 0, false, false},
+	} {
+		var rdg SmapReading
+		if err := json.Unmarshal([]byte(test.reading), &rdg); err != nil {
+			t.Fatal(err)
+		}
+		if rdg.Null() != test.null {
+			t.Errorf("%s: Null() is %v", test.reading, rdg.Null())
+		}
+		if value, ok := rdg.Number(); ok != test.numeric || value != test.number {
+			t.Errorf("%s: Number() is %v, %v; expected %v, %v", test.reading, value, ok, test.number, test.numeric)
+		}
+	}
+}
+
+func TestSmapReadingInvalid(t *testing.T) {
+	for _, reading := range []string{`[1500000000]`, `[1500000000, 1, 2]`, `["now", 1]`, `72.5`} {
+		var rdg SmapReading
+		if err := json.Unmarshal([]byte(reading), &rdg); err == nil {
+			t.Errorf("Decoded invalid reading %s", reading)
+		}
+	}
+}
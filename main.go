@@ -1,24 +1,29 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"net/http"
+	"io/ioutil"
 	"os"
 	"strings"
-	"sync/atomic"
+	"text/tabwriter"
 	"time"
 
-	hod "github.com/gtfierro/hod/clients/go"
+	"github.com/codegangsta/cli"
 	"github.com/op/go-logging"
-	"goji.io"
-	"goji.io/pat"
-	bw2 "gopkg.in/immesys/bw2bind.v5"
+	"github.com/pkg/errors"
 )
 
 // logger
 var log *logging.Logger
 
+const bufferFile = ".sWAP.db"
+
+// outbound messages are buffered here while BOSSWAVE is unreachable
+const queueFile = ".sWAP.queue.db"
+
+// the signal names given to points, so they are stable across restarts
+const signalsFile = ".sWAP.signals.db"
+
 // set up logging facilities
 func init() {
 	log = logging.MustGetLogger("sWAP")
@@ -29,80 +34,379 @@ func init() {
 	logging.SetFormatter(logging.MustStringFormatter(format))
 }
 
-type server struct {
-	mux          *goji.Mux
-	hod          *hod.HodClientBW2
-	bw2          *bw2.BW2Client
-	num_received uint64
-	num_metadata uint64
-	num_readings uint64
+func doServer(c *cli.Context) error {
+	level, err := logging.LogLevel(c.String("loglevel"))
+	if err != nil {
+		return errors.Wrap(err, "Invalid log level")
+	}
+	logging.SetLevel(level, "sWAP")
+
+	cfg := serverConfig{
+		address:          c.String("address"),
+		pidfile:          c.String("pidfile"),
+		adminSocket:      c.String("socket"),
+		hodURI:           c.String("hod"),
+		entity:           c.String("entity"),
+		taxonomy:         defaultTaxonomy,
+		signalNames:      defaultSignalNames,
+		signalNaming:     c.String("signal-naming"),
+		resolvers:        strings.Split(c.String("resolvers"), ","),
+		mappingFile:      c.String("mapping"),
+		configFile:       c.String("config"),
+		batch:            c.Bool("batch"),
+		cacheTTL:         c.Duration("cache-ttl"),
+		negativeCacheTTL: c.Duration("negative-cache-ttl"),
+		classRefresh:     c.Duration("class-refresh"),
+		expiryWarning:    c.Duration("expiry-warning"),
+	}
+	if files := c.String("model"); files != "" {
+		cfg.modelFiles = strings.Split(files, ",")
+	}
+	if cfg.entity == "" && cfg.usesHod() {
+		return errors.New("Need to supply an entity file for the server (--entity or BW2_DEFAULT_ENTITY)")
+	}
+	if err := checkResolvers(cfg.resolvers); err != nil {
+		return err
+	}
+	if cfg.fallbackTemplate = c.String("fallback-template"); cfg.fallbackTemplate == noFallback {
+		cfg.fallbackTemplate = ""
+	} else if err := checkTemplate(cfg.fallbackTemplate, false); err != nil {
+		return err
+	}
+	cfg.uriTemplate = c.String("uri-template")
+	if err := checkTemplate(cfg.uriTemplate, true); err != nil {
+		return err
+	}
+	if err := checkSignalNaming(cfg.signalNaming); err != nil {
+		return err
+	}
+	if cfg.classRefresh <= 0 {
+		return errors.New("Class refresh interval must be positive")
+	}
+	if filename := c.String("taxonomy"); filename != "" {
+		if cfg.taxonomy, cfg.signalNames, err = loadTaxonomy(filename); err != nil {
+			return err
+		}
+	}
+	if cfg.timeUnit, err = ParseUOT(c.String("timeunit")); err != nil {
+		return err
+	}
+
+	agent := c.String("agent")
+	store := newStore(bufferFile, agent, c.Int("connections"))
+	publisher := newBW2Publisher(store)
+	queue, err := newQueue(queueFile, c.Int("queue-size"), c.Duration("queue-retry"), publisher)
+	if err != nil {
+		return err
+	}
+	startServer(cfg, store, publisher, queue)
+	return nil
 }
 
-func startServer(address string, hoduri string) {
+func doRegister(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("Need to supply an entity file name")
+	}
+	filename := c.Args().Get(0)
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Could not read entity file %s", filename)
+	}
 
-	s := &server{
-		mux:          goji.NewMux(),
-		num_received: 0,
-		num_metadata: 0,
-		num_readings: 0,
+	client := newAdminClient(c.String("socket"))
+	vk, err := client.addEntity(contents)
+	if err != nil {
+		return errors.Wrapf(err, "Could not register %s", filename)
 	}
+	fmt.Printf("Registered entity with VK= %s\n", vk)
+	return nil
+}
 
-	go func() {
-		tick := time.NewTicker(10 * time.Second)
-		for _ = range tick.C {
-			received := atomic.SwapUint64(&s.num_received, 0)
-			metadata := atomic.SwapUint64(&s.num_metadata, 0)
-			readings := atomic.SwapUint64(&s.num_readings, 0)
-			fmt.Printf("%s: msgs/metadata/timeseries = %d/%d/%d\n", time.Now(), received, metadata, readings)
+func doListEntities(c *cli.Context) error {
+	client := newAdminClient(c.String("socket"))
+	infos, err := client.listEntities()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VK\tCONTACT\tCOMMENT\tEXPIRES\tLAST USED\tSTATUS")
+	for _, info := range infos {
+		status := "ok"
+		if info.Error != "" {
+			status = "error"
 		}
-	}()
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", info.VK, info.Contact, info.Comment, formatTime(info.Expires), formatTime(info.LastUsed), status)
+	}
+	return tw.Flush()
+}
 
-	// define Hod client
-	s.bw2 = bw2.ConnectOrExit("")
-	s.bw2.OverrideAutoChainTo(true)
-	s.bw2.SetEntityFromEnvironOrExit()
-	bc, err := hod.NewBW2Client(s.bw2, hoduri)
+func doShowEntity(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("Need to supply a VK")
+	}
+	client := newAdminClient(c.String("socket"))
+	info, err := client.getEntity(c.Args().Get(0))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	s.hod = bc
+	fmt.Printf("VK:        %s\n", info.VK)
+	fmt.Printf("Contact:   %s\n", info.Contact)
+	fmt.Printf("Comment:   %s\n", info.Comment)
+	fmt.Printf("Created:   %s\n", formatTime(info.Created))
+	fmt.Printf("Expires:   %s\n", formatTime(info.Expires))
+	fmt.Printf("Last used: %s\n", formatTime(info.LastUsed))
+	for _, alias := range info.Aliases {
+		fmt.Printf("Replaces:  %s\n", alias)
+	}
+	if info.File != "" {
+		fmt.Printf("File:      %s\n", info.File)
+	}
+	if info.Error != "" {
+		fmt.Printf("Error:     %s\n", info.Error)
+	}
+	return nil
+}
 
-	s.mux.HandleFunc(pat.Post("/add/*"), s.add)
-	log.Noticef("Serving on %s...", address)
-	log.Fatal(http.ListenAndServe(address, s.mux))
+func doRemoveEntity(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("Need to supply a VK")
+	}
+	vk := c.Args().Get(0)
+	client := newAdminClient(c.String("socket"))
+	if err := client.removeEntity(vk); err != nil {
+		return errors.Wrapf(err, "Could not remove %s", vk)
+	}
+	fmt.Printf("Removed entity with VK= %s\n", vk)
+	return nil
 }
 
-func (s *server) add(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	atomic.AddUint64(&s.num_received, 1)
-	// extract the VK and path from the URI
-	baseuri := strings.TrimPrefix(r.URL.String(), pat.Post("/add/").PathPrefix())
-	// get the client for the corresponding vk
-
-	var msgs map[string]SmapMessage
-	dec := json.NewDecoder(r.Body)
-	dec.UseNumber()
-	if err := dec.Decode(&msgs); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	for _, msg := range msgs {
-		//log.Debugf("%+v", msg)
-		atomic.AddUint64(&s.num_metadata, uint64(len(msg.Metadata)))
-		atomic.AddUint64(&s.num_readings, uint64(len(msg.Readings)))
-
-		if err := s.forward(msg.UUID, msg.Readings, baseuri); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		} else {
-			log.Debugf("baseuri %s", baseuri)
-		}
+func doRotateEntity(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return errors.New("Need to supply a VK and a new entity file name")
+	}
+	vk := c.Args().Get(0)
+	filename := c.Args().Get(1)
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Could not read entity file %s", filename)
 	}
+	client := newAdminClient(c.String("socket"))
+	newvk, err := client.rotateEntity(vk, contents)
+	if err != nil {
+		return errors.Wrapf(err, "Could not rotate %s", vk)
+	}
+	fmt.Printf("Rotated entity with VK= %s to VK= %s\n", vk, newvk)
+	return nil
+}
 
-	w.WriteHeader(200)
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
 }
 
 func main() {
-	startServer("127.0.0.1:8001", "scratch.ns/hod")
+	// used by all commands that talk to a running server
+	socketFlag := cli.StringFlag{
+		Name:   "socket,s",
+		Value:  "sWAP.sock",
+		EnvVar: "SWAP_ADMIN_SOCKET",
+		Usage:  "Path to the admin socket of the running server",
+	}
+
+	app := cli.NewApp()
+	app.Name = "sWAP"
+	app.Usage = "sMAP to WAVE Acclimation Proxy"
+	app.Version = "0.4"
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "server",
+			Usage:  "Start the proxy server",
+			Action: doServer,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "address,a",
+					Value:  "localhost:8078",
+					EnvVar: "SWAP_ADDRESS",
+					Usage:  "Address to listen on",
+				},
+				cli.StringFlag{
+					Name:   "pidfile,pf",
+					Value:  "sWAP.pid",
+					EnvVar: "SWAP_PIDFILE",
+					Usage:  "Path to the file where we store the PID for the server",
+				},
+				cli.StringFlag{
+					Name:   "socket,s",
+					Value:  "sWAP.sock",
+					EnvVar: "SWAP_ADMIN_SOCKET",
+					Usage:  "Path to the Unix socket for the admin API",
+				},
+				cli.StringFlag{
+					Name:   "agent",
+					Value:  "127.0.0.1:28589",
+					EnvVar: "BW2_AGENT",
+					Usage:  "Address of BW2 agent",
+				},
+				cli.IntFlag{
+					Name:   "connections",
+					Value:  16,
+					EnvVar: "SWAP_AGENT_CONNECTIONS",
+					Usage:  "Number of agent connections shared by registered entities",
+				},
+				cli.StringFlag{
+					Name:   "entity,e",
+					EnvVar: "BW2_DEFAULT_ENTITY",
+					Usage:  "Entity file the server uses to query Hod (not needed with --model unless the hod resolver is used)",
+				},
+				cli.StringFlag{
+					Name:   "hod",
+					Value:  "scratch.ns/hod",
+					EnvVar: "SWAP_HOD_URI",
+					Usage:  "BOSSWAVE URI of the HodDB service",
+				},
+				cli.StringFlag{
+					Name:   "config,c",
+					EnvVar: "SWAP_CONFIG",
+					Usage:  "YAML file describing sources; reloaded on SIGHUP",
+				},
+				cli.StringFlag{
+					Name:   "resolvers",
+					Value:  "hod",
+					EnvVar: "SWAP_RESOLVERS",
+					Usage:  "Comma-separated resolvers to try in order when mapping UUIDs to Brick points (hod, file, model, metadata)",
+				},
+				cli.StringFlag{
+					Name:   "mapping",
+					EnvVar: "SWAP_MAPPING",
+					Usage:  "CSV or JSON file mapping UUIDs to Brick points, used by the file resolver",
+				},
+				cli.StringFlag{
+					Name:   "model",
+					EnvVar: "SWAP_BRICK_MODEL",
+					Usage:  "Comma-separated Brick model and schema files (Turtle) used by the model resolver and for Brick classes instead of Hod; reloaded when they change",
+				},
+				cli.StringFlag{
+					Name:   "uri-template",
+					Value:  brickTemplate,
+					EnvVar: "SWAP_URI_TEMPLATE",
+					Usage:  "URI template for reports sent to /add/<vk>/uri/<base uri>",
+				},
+				cli.StringFlag{
+					Name:   "fallback-template",
+					Value:  fallbackTemplate,
+					EnvVar: "SWAP_FALLBACK_TEMPLATE",
+					Usage:  "URI template for timeseries whose UUID can't be resolved (\"none\" to reject them)",
+				},
+				cli.StringFlag{
+					Name:   "taxonomy,t",
+					EnvVar: "SWAP_TAXONOMY",
+					Usage:  "YAML file of generic classes; uses the built-in classes if empty",
+				},
+				cli.StringFlag{
+					Name:   "signal-naming",
+					Value:  signalByClass,
+					EnvVar: "SWAP_SIGNAL_NAMING",
+					Usage:  "How to name the signal of each point: after its Brick class (class), generic class (generic) or Brick name (name), or info for one signal per equipment",
+				},
+				cli.StringFlag{
+					Name:   "loglevel,l",
+					Value:  "INFO",
+					EnvVar: "SWAP_LOGLEVEL",
+					Usage:  "Log level (CRITICAL, ERROR, WARNING, NOTICE, INFO, DEBUG)",
+				},
+				cli.BoolFlag{
+					Name:   "batch",
+					EnvVar: "SWAP_BATCH",
+					Usage:  "Publish all readings of a sMAP message as one BatchMessage",
+				},
+				cli.StringFlag{
+					Name:   "timeunit",
+					Value:  "ns",
+					EnvVar: "SWAP_TIME_UNIT",
+					Usage:  "Unit of time for published timestamps (s, ms, us, ns)",
+				},
+				cli.DurationFlag{
+					Name:   "cache-ttl",
+					Value:  10 * time.Minute,
+					EnvVar: "SWAP_CACHE_TTL",
+					Usage:  "How long to cache the Brick resolution of a UUID",
+				},
+				cli.DurationFlag{
+					Name:   "negative-cache-ttl",
+					Value:  1 * time.Minute,
+					EnvVar: "SWAP_NEGATIVE_CACHE_TTL",
+					Usage:  "How long to remember that a UUID has no Brick resolution",
+				},
+				cli.DurationFlag{
+					Name:   "class-refresh",
+					Value:  1 * time.Hour,
+					EnvVar: "SWAP_CLASS_REFRESH",
+					Usage:  "How often to reload the Brick subclass closure from Hod",
+				},
+				cli.DurationFlag{
+					Name:   "expiry-warning",
+					Value:  30 * 24 * time.Hour,
+					EnvVar: "SWAP_EXPIRY_WARNING",
+					Usage:  "Warn about registered entities that expire within this long",
+				},
+				cli.IntFlag{
+					Name:   "queue-size",
+					Value:  100000,
+					EnvVar: "SWAP_QUEUE_SIZE",
+					Usage:  "Maximum number of messages buffered while BOSSWAVE is unreachable",
+				},
+				cli.DurationFlag{
+					Name:   "queue-retry",
+					Value:  5 * time.Second,
+					EnvVar: "SWAP_QUEUE_RETRY",
+					Usage:  "How long to wait between attempts to publish buffered messages",
+				},
+			},
+		},
+		{
+			Name:   "register",
+			Usage:  "Register an entity so it can be used",
+			Action: doRegister,
+			Flags:  []cli.Flag{socketFlag},
+		},
+		{
+			Name:  "entities",
+			Usage: "Manage the entities registered with a running server",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List registered entities",
+					Action: doListEntities,
+					Flags:  []cli.Flag{socketFlag},
+				},
+				{
+					Name:      "show",
+					Usage:     "Show details of a registered entity",
+					ArgsUsage: "<vk>",
+					Action:    doShowEntity,
+					Flags:     []cli.Flag{socketFlag},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove a registered entity",
+					ArgsUsage: "<vk>",
+					Action:    doRemoveEntity,
+					Flags:     []cli.Flag{socketFlag},
+				},
+				{
+					Name:      "rotate",
+					Usage:     "Replace a registered entity; reports using the old VK are published with the new entity",
+					ArgsUsage: "<vk> <new entity file>",
+					Action:    doRotateEntity,
+					Flags:     []cli.Flag{socketFlag},
+				},
+			},
+		},
+	}
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// remembers the metadata values we last persisted on each URI so that we
+// only sign and send the keys that actually changed
+type metadataTracker struct {
+	// uri -> key -> value
+	written map[string]map[string]string
+	sync.Mutex
+}
+
+func newMetadataTracker() *metadataTracker {
+	return &metadataTracker{
+		written: make(map[string]map[string]string),
+	}
+}
+
+// returns the subset of the metadata that differs from what was last written on the URI
+func (t *metadataTracker) changed(uri string, md map[string]string) map[string]string {
+	t.Lock()
+	defer t.Unlock()
+	var ret = make(map[string]string)
+	for k, v := range md {
+		if prev, found := t.written[uri][k]; !found || prev != v {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// records that the key was written on the URI with the given value
+func (t *metadataTracker) mark(uri, key, value string) {
+	t.Lock()
+	defer t.Unlock()
+	if _, found := t.written[uri]; !found {
+		t.written[uri] = make(map[string]string)
+	}
+	t.written[uri][key] = value
+}
+
+// collects the flattened sMAP Metadata and Properties and the resolved Brick
+// fields for a message into the key/value pairs we persist on BOSSWAVE
+func buildMetadata(msg SmapMessage, info *pointInfo) map[string]string {
+	var md = make(map[string]string)
+	for k, v := range flatten(msg.Metadata) {
+		vs, ok := v.(string)
+		if !ok {
+			vs = fmt.Sprintf("%v", v)
+		}
+		md["Metadata."+k] = vs
+	}
+	if props := msg.Properties; props != nil {
+		if props.UnitOfTime != 0 {
+			md["Properties.UnitofTime"] = props.UnitOfTime.String()
+		}
+		if props.UnitOfMeasure != "" {
+			md["Properties.UnitofMeasure"] = props.UnitOfMeasure
+		}
+		if props.StreamType != 0 {
+			md["Properties.StreamType"] = props.StreamType.String()
+		}
+	}
+	// these are empty if the source doesn't resolve through Hod
+	if info.Class != "" {
+		md["Brick.Name"] = info.Name
+		md["Brick.Class"] = info.Class
+		md["Brick.Equipment"] = info.Equipment
+		md["Brick.EquipmentClass"] = info.EquipmentClass
+	}
+	return md
+}
+
+// Returns where the metadata of a timeseries published on uri is persisted.
+// If the template can give several timeseries the same URI (e.g. signal/info
+// for every point of an equipment), each one gets a sub-URI named after its
+// UUID so that they don't overwrite each other's keys
+func (s *server) metadataURI(template, uri string, msg SmapMessage) string {
+	for _, match := range templateVar.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "uuid", "path", "name":
+			return uri
+		case "signal":
+			if s.cfg.signalNaming != signalInfo {
+				return uri
+			}
+		}
+	}
+	return uri + "/" + sanitizeSegment(msg.UUID)
+}
+
+// persists the message's metadata on the URI, skipping keys whose values
+// haven't changed since we last wrote them
+func (s *server) persistMetadata(vk, uri string, msg SmapMessage, info *pointInfo) error {
+	changed := s.metadata.changed(uri, buildMetadata(msg, info))
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := s.publisher.SetMetadata(vk, uri, changed); err != nil {
+		return errors.Wrapf(err, "Could not set metadata on %s", uri)
+	}
+	for k, v := range changed {
+		s.metadata.mark(uri, k, v)
+	}
+	return nil
+}
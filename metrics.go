@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics, served on /metrics. Per-report metrics are labelled by
+// source (the config source name, or the VK for ad hoc reports) and base URI
+var (
+	reportsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_reports_total",
+		Help: "sMAP reports received on /add",
+	}, []string{"source", "baseuri"})
+	readingsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_readings_total",
+		Help: "sMAP readings received",
+	}, []string{"source", "baseuri"})
+	metadataReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_metadata_keys_total",
+		Help: "sMAP metadata keys received (after inheritance)",
+	}, []string{"source", "baseuri"})
+	pathsForwarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_paths_total",
+		Help: "sMAP timeseries handled, by outcome (published, buffered, unresolved, rejected)",
+	}, []string{"source", "baseuri", "status"})
+	publishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "swap_publish_duration_seconds",
+		Help:    "Time to publish (or buffer) the readings of one timeseries",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"source", "baseuri"})
+	hodQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "swap_hod_query_duration_seconds",
+		Help:    "Time taken by Hod queries, by kind of query (resolve, subclasses)",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_cache_lookups_total",
+		Help: "Resolution cache lookups, by result (hit, miss)",
+	}, []string{"result"})
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_errors_total",
+		Help: "Errors, by type",
+	}, []string{"type"})
+	actuationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_actuations_total",
+		Help: "Writes to actuator slots, by result (ok, invalid, failed)",
+	}, []string{"result"})
+
+	// number of registered entities that expire within the warning window
+	entitiesExpiring = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "swap_entities_expiring",
+		Help: "Registered entities that expire within the warning window",
+	})
+	// for entities within the warning window
+	entityExpirySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "swap_entity_expiry_seconds",
+		Help: "Seconds until a registered entity expires, for entities within the warning window",
+	}, []string{"vk"})
+)
+
+// values for the type label of swap_errors_total
+const (
+	errorDecode     = "decode"
+	errorUnknownVK  = "unknown_vk"
+	errorResolve    = "resolve"
+	errorTemplate   = "template"
+	errorUnresolved = "unresolved"
+	errorMetadata   = "metadata"
+	errorPublish    = "publish"
+	errorQueueFull  = "queue_full"
+)
+
+// values for the result label of swap_actuations_total
+const (
+	actuationOK      = "ok"
+	actuationInvalid = "invalid"
+	actuationFailed  = "failed"
+)
+
+func init() {
+	prometheus.MustRegister(
+		reportsReceived,
+		readingsReceived,
+		metadataReceived,
+		pathsForwarded,
+		publishDuration,
+		hodQueryDuration,
+		cacheLookups,
+		errorsTotal,
+		actuationsTotal,
+		entitiesExpiring,
+		entityExpirySeconds,
+	)
+}
+
+// exports the number of messages waiting in the queue
+func registerQueueDepth(q *outboundQueue) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "swap_queue_depth",
+		Help: "Messages waiting in the outbound queue",
+	}, func() float64 {
+		return float64(q.size())
+	}))
+}
+
+// the value of the source label for the given source
+func (src *source) label() string {
+	if src.name != "" {
+		return src.name
+	}
+	return src.vk
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gtfierro/hod/turtle"
+	"github.com/pkg/errors"
+)
+
+// how often we check whether the Brick model file has changed
+const modelCheckInterval = 10 * time.Second
+
+// name of the resolver that uses the local Brick model
+const modelResolverName = "model"
+
+// A Brick model loaded from Turtle files: usually the building's model plus
+// the Brick schema files that define the class hierarchy. Answers the same
+// questions we would otherwise send to Hod: which point has a UUID, what its
+// class and equipment are, and what the subclasses of a class are. Entities
+// and predicates are matched on their local names, so any version of the
+// Brick namespaces works
+type brickModel struct {
+	filenames []string
+	// filename -> modification time when we loaded it
+	modTimes map[string]time.Time
+	// uuid -> point
+	points map[string]string
+	// entity -> its rdf:types
+	types map[string][]string
+	// point -> equipment it is a point of (or part of)
+	equipment map[string]string
+	// class -> its direct subclasses
+	subclasses map[string][]string
+	sync.RWMutex
+}
+
+// loads the model from the given Turtle files
+func newBrickModel(filenames []string) (*brickModel, error) {
+	m := &brickModel{filenames: filenames}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parses the files and swaps in the new model
+func (m *brickModel) load() error {
+	var (
+		modTimes   = make(map[string]time.Time)
+		triples    []turtle.Triple
+		points     = make(map[string]string)
+		types      = make(map[string][]string)
+		equipment  = make(map[string]string)
+		subclasses = make(map[string][]string)
+	)
+	for _, filename := range m.filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return errors.Wrapf(err, "Could not read Brick model %s", filename)
+		}
+		dataset, _, err := turtle.GetParser().Parse(filename)
+		if err != nil {
+			return errors.Wrapf(err, "Could not parse Brick model %s", filename)
+		}
+		modTimes[filename] = info.ModTime()
+		triples = append(triples, dataset.Triples...)
+	}
+	for _, triple := range triples {
+		subject, object := triple.Subject.Value, triple.Object.Value
+		switch triple.Predicate.Value {
+		case "uuid":
+			points[strings.Trim(object, `"`)] = subject
+		case "type":
+			// individuals are also typed as owl:NamedIndividual
+			if object != "NamedIndividual" {
+				types[subject] = append(types[subject], object)
+			}
+		case "isPointOf", "isPartOf":
+			// like the Hod query, prefer isPointOf
+			if _, found := equipment[subject]; !found || triple.Predicate.Value == "isPointOf" {
+				equipment[subject] = object
+			}
+		case "subClassOf":
+			subclasses[object] = append(subclasses[object], subject)
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.modTimes = modTimes
+	m.points = points
+	m.types = types
+	m.equipment = equipment
+	m.subclasses = subclasses
+	log.Noticef("Loaded Brick model %s (%d triples, %d points)", strings.Join(m.filenames, ", "), len(triples), len(points))
+	return nil
+}
+
+// returns true if any of the files was modified since we loaded it
+func (m *brickModel) changed() bool {
+	m.RLock()
+	defer m.RUnlock()
+	for _, filename := range m.filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "Could not check Brick model %s", filename))
+			continue
+		}
+		if !info.ModTime().Equal(m.modTimes[filename]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks the files every interval and reloads them if any changed, calling
+// onChange after each successful reload
+func (m *brickModel) watch(interval time.Duration, onChange func()) {
+	for _ = range time.Tick(interval) {
+		if !m.changed() {
+			continue
+		}
+		if err := m.load(); err != nil {
+			// keep using the old model
+			log.Error(err)
+			continue
+		}
+		onChange()
+	}
+}
+
+// implements PointResolver
+func (m *brickModel) Resolve(msg SmapMessage) (*pointInfo, error) {
+	m.RLock()
+	defer m.RUnlock()
+	name, found := m.points[msg.UUID]
+	if !found {
+		return nil, nil
+	}
+	// the Hod query needs a class, an equipment and an equipment class
+	equip, found := m.equipment[name]
+	if !found || len(m.types[name]) == 0 || len(m.types[equip]) == 0 {
+		return nil, nil
+	}
+	return &pointInfo{
+		Name:           name,
+		Class:          m.types[name][0],
+		Equipment:      equip,
+		EquipmentClass: m.types[equip][0],
+	}, nil
+}
+
+// implements classSource
+func (m *brickModel) subclassesOf(class string) ([]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var (
+		seen    = map[string]bool{class: true}
+		result  = []string{class}
+		pending = []string{class}
+	)
+	for len(pending) > 0 {
+		next := pending[0]
+		pending = pending[1:]
+		for _, sub := range m.subclasses[next] {
+			if !seen[sub] {
+				seen[sub] = true
+				result = append(result, sub)
+				pending = append(pending, sub)
+			}
+		}
+	}
+	return result, nil
+}
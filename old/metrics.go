@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics, served on /metrics and labelled by the VK and base URI
+// of the report
+var (
+	reportsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_reports_total",
+		Help: "sMAP reports received on /add",
+	}, []string{"vk", "baseuri"})
+	readingsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_readings_total",
+		Help: "sMAP readings received",
+	}, []string{"vk", "baseuri"})
+	metadataReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_metadata_keys_total",
+		Help: "sMAP metadata keys received",
+	}, []string{"vk", "baseuri"})
+	publishDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "swap_publish_duration_seconds",
+		Help:    "Time to publish one reading",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"vk", "baseuri"})
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "swap_errors_total",
+		Help: "Errors, by type (unknown_vk, decode, publish)",
+	}, []string{"type"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		reportsReceived,
+		readingsReceived,
+		metadataReceived,
+		publishDuration,
+		errorsTotal,
+	)
+}
@@ -7,10 +7,10 @@ import (
 	"net/http"
 	"os"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"goji.io"
 	"goji.io/pat"
 	"goji.io/pattern"
@@ -19,11 +19,8 @@ import (
 )
 
 type server struct {
-	mux          *goji.Mux
-	store        *entityStore
-	num_received uint64
-	num_metadata uint64
-	num_readings uint64
+	mux   *goji.Mux
+	store *entityStore
 }
 
 func startServer(address string, store *entityStore, pidfile string) {
@@ -44,24 +41,12 @@ func startServer(address string, store *entityStore, pidfile string) {
 	}
 
 	s := &server{
-		mux:          goji.NewMux(),
-		store:        store,
-		num_received: 0,
-		num_metadata: 0,
-		num_readings: 0,
+		mux:   goji.NewMux(),
+		store: store,
 	}
 
-	go func() {
-		tick := time.NewTicker(10 * time.Second)
-		for _ = range tick.C {
-			received := atomic.SwapUint64(&s.num_received, 0)
-			metadata := atomic.SwapUint64(&s.num_metadata, 0)
-			readings := atomic.SwapUint64(&s.num_readings, 0)
-			fmt.Printf("%s: msgs/metadata/timeseries = %d/%d/%d\n", time.Now(), received, metadata, readings)
-		}
-	}()
-
 	s.mux.HandleFuncC(pat.Post("/add/:vk/uri/*"), s.add)
+	s.mux.Handle(pat.Get("/metrics"), promhttp.Handler())
 	log.Noticef("Serving on %s...", address)
 	log.Fatal(http.ListenAndServe(address, s.mux))
 
@@ -69,13 +54,14 @@ func startServer(address string, store *entityStore, pidfile string) {
 
 func (s *server) add(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	atomic.AddUint64(&s.num_received, 1)
 	// extract the VK and path from the URI
 	vk := pat.Param(ctx, "vk")
 	baseuri := strings.TrimPrefix(pattern.Path(ctx), "/")
+	reportsReceived.WithLabelValues(vk, baseuri).Inc()
 	// get the client for the corresponding vk
 	client := s.store.getClientForVK(vk)
 	if client == nil {
+		errorsTotal.WithLabelValues("unknown_vk").Inc()
 		w.WriteHeader(400)
 		w.Write([]byte(fmt.Sprintf("No bw2 client found for vk %s", vk)))
 		return
@@ -84,6 +70,7 @@ func (s *server) add(ctx context.Context, w http.ResponseWriter, r *http.Request
 	// pull the posted JSON out of the sMAP message
 	messages, err := handleJSON(r.Body)
 	if err != nil {
+		errorsTotal.WithLabelValues("decode").Inc()
 		log.Errorf("Error handling JSON %s", err)
 		w.WriteHeader(400)
 		w.Write([]byte(err.Error()))
@@ -92,7 +79,7 @@ func (s *server) add(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	// persist the metadata we extract
 	for _, msg := range messages {
-		atomic.AddUint64(&s.num_metadata, uint64(len(msg.Metadata)))
+		metadataReceived.WithLabelValues(vk, baseuri).Add(float64(len(msg.Metadata)))
 		for k, v := range msg.Metadata {
 			vs, ok := v.(string)
 			if !ok {
@@ -108,17 +95,21 @@ func (s *server) add(ctx context.Context, w http.ResponseWriter, r *http.Request
 
 	// find timeseries data, form POs, and publish
 	for _, msg := range messages {
-		atomic.AddUint64(&s.num_readings, uint64(len(msg.Readings)))
+		readingsReceived.WithLabelValues(vk, baseuri).Add(float64(len(msg.Readings)))
 		if len(msg.Readings) > 0 {
 			uri := buildURI(baseuri, msg.Path)
 			po := TimeseriesReading{UUID: string(msg.UUID)}
 			for _, rdg := range msg.Readings {
 				po.Time = int64(rdg.GetTime())
 				po.Value = rdg.GetValue().(float64)
-				if err := client.Publish(&bw2.PublishParams{
+				start := time.Now()
+				err := client.Publish(&bw2.PublishParams{
 					URI:            uri,
 					PayloadObjects: []bw2.PayloadObject{po.ToMsgPackBW()},
-				}); err != nil {
+				})
+				publishDuration.WithLabelValues(vk, baseuri).Observe(time.Since(start).Seconds())
+				if err != nil {
+					errorsTotal.WithLabelValues("publish").Inc()
 					log.Errorf("Error publishing message %s", err)
 					w.WriteHeader(400)
 					w.Write([]byte(err.Error()))
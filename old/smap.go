@@ -229,13 +229,16 @@ func (tsm *TieredSmapMessage) CollapseToTimeseries() {
 				}
 			}
 			if prefixMsg.Properties != nil && !prefixMsg.Properties.IsEmpty() {
-				if msg.Properties.UnitOfTime != 0 {
+				if msg.Properties == nil {
+					msg.Properties = &SmapProperties{}
+				}
+				if msg.Properties.UnitOfTime == 0 {
 					msg.Properties.UnitOfTime = prefixMsg.Properties.UnitOfTime
 				}
-				if msg.Properties.UnitOfMeasure != "" {
+				if msg.Properties.UnitOfMeasure == "" {
 					msg.Properties.UnitOfMeasure = prefixMsg.Properties.UnitOfMeasure
 				}
-				if msg.Properties.StreamType != 0 {
+				if msg.Properties.StreamType == 0 {
 					msg.Properties.StreamType = prefixMsg.Properties.StreamType
 				}
 			}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Everything sWAP does on BOSSWAVE on behalf of an entity. Publish, Persist
+// and SetMetadata return errAgentUnavailable (possibly wrapped) if the message
+// could be delivered later, and errUnknownVK if there is no such entity
+type Publisher interface {
+	Publish(vk, uri string, pos ...bw2.PayloadObject) error
+	// like Publish, but the router keeps the message for later subscribers
+	Persist(vk, uri string, pos ...bw2.PayloadObject) error
+	SetMetadata(vk, uri string, metadata map[string]string) error
+	Subscribe(vk, uri string) (chan *bw2.SimpleMessage, error)
+}
+
+// publishes through the local BW2 agent using the entities in the store
+type bw2Publisher struct {
+	store *entityStore
+}
+
+func newBW2Publisher(store *entityStore) *bw2Publisher {
+	return &bw2Publisher{store: store}
+}
+
+func (p *bw2Publisher) Publish(vk, uri string, pos ...bw2.PayloadObject) error {
+	return p.publish(vk, uri, false, pos)
+}
+
+func (p *bw2Publisher) Persist(vk, uri string, pos ...bw2.PayloadObject) error {
+	return p.publish(vk, uri, true, pos)
+}
+
+func (p *bw2Publisher) publish(vk, uri string, persist bool, pos []bw2.PayloadObject) error {
+	return p.store.do(vk, func(client *bw2.BW2Client) error {
+		return client.Publish(&bw2.PublishParams{
+			URI:            uri,
+			PayloadObjects: pos,
+			Persist:        persist,
+		})
+	})
+}
+
+func (p *bw2Publisher) SetMetadata(vk, uri string, metadata map[string]string) error {
+	return p.store.do(vk, func(client *bw2.BW2Client) error {
+		for k, v := range metadata {
+			if err := client.SetMetadata(uri, k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The subscription lives on one of the shared agent connections; if that
+// connection is lost, the channel stops receiving and the caller has to
+// subscribe again
+func (p *bw2Publisher) Subscribe(vk, uri string) (chan *bw2.SimpleMessage, error) {
+	var c chan *bw2.SimpleMessage
+	err := p.store.do(vk, func(client *bw2.BW2Client) (err error) {
+		c, err = client.Subscribe(&bw2.SubscribeParams{
+			URI: uri,
+		})
+		return
+	})
+	return c, err
+}
+
+// a message recorded by the memoryPublisher
+type recordedMessage struct {
+	VK        string
+	URI       string
+	POs       []bw2.PayloadObject
+	Persisted bool
+}
+
+// Records everything in memory instead of talking to BOSSWAVE, so sWAP can
+// run without a router. Published messages are also delivered to matching
+// subscriptions. Any VK is accepted
+type memoryPublisher struct {
+	messages []recordedMessage
+	// uri -> key -> value
+	metadata map[string]map[string]string
+	// subscribed uri -> channels
+	subscriptions map[string][]chan *bw2.SimpleMessage
+	// if true, Publish, Persist and SetMetadata fail as if the agent were down
+	offline bool
+	sync.Mutex
+}
+
+func newMemoryPublisher() *memoryPublisher {
+	return &memoryPublisher{
+		metadata:      make(map[string]map[string]string),
+		subscriptions: make(map[string][]chan *bw2.SimpleMessage),
+	}
+}
+
+func (p *memoryPublisher) Publish(vk, uri string, pos ...bw2.PayloadObject) error {
+	return p.publish(vk, uri, false, pos)
+}
+
+func (p *memoryPublisher) Persist(vk, uri string, pos ...bw2.PayloadObject) error {
+	return p.publish(vk, uri, true, pos)
+}
+
+func (p *memoryPublisher) publish(vk, uri string, persist bool, pos []bw2.PayloadObject) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.offline {
+		return errAgentUnavailable
+	}
+	p.messages = append(p.messages, recordedMessage{VK: vk, URI: uri, POs: pos, Persisted: persist})
+	for pattern, channels := range p.subscriptions {
+		if !matchURI(pattern, uri) {
+			continue
+		}
+		for _, c := range channels {
+			// don't block on subscribers that aren't reading
+			select {
+			case c <- &bw2.SimpleMessage{From: vk, URI: uri, POs: pos}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (p *memoryPublisher) SetMetadata(vk, uri string, metadata map[string]string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.offline {
+		return errAgentUnavailable
+	}
+	if _, found := p.metadata[uri]; !found {
+		p.metadata[uri] = make(map[string]string)
+	}
+	for k, v := range metadata {
+		p.metadata[uri][k] = v
+	}
+	return nil
+}
+
+func (p *memoryPublisher) Subscribe(vk, uri string) (chan *bw2.SimpleMessage, error) {
+	p.Lock()
+	defer p.Unlock()
+	c := make(chan *bw2.SimpleMessage, 100)
+	p.subscriptions[uri] = append(p.subscriptions[uri], c)
+	return c, nil
+}
+
+// makes Publish, Persist and SetMetadata fail as if the agent were down (or not)
+func (p *memoryPublisher) setOffline(offline bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.offline = offline
+}
+
+// returns the messages published so far
+func (p *memoryPublisher) published() []recordedMessage {
+	p.Lock()
+	defer p.Unlock()
+	return append([]recordedMessage{}, p.messages...)
+}
+
+// returns the metadata persisted on the given uri so far
+func (p *memoryPublisher) persisted(uri string) map[string]string {
+	p.Lock()
+	defer p.Unlock()
+	var md = make(map[string]string)
+	for k, v := range p.metadata[uri] {
+		md[k] = v
+	}
+	return md
+}
+
+// returns true if the uri matches the subscription pattern, which may use
+// the BOSSWAVE wildcards '+' (one segment) and '*' (any number of segments)
+func matchURI(pattern, uri string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(uri, "/"))
+}
+
+func matchSegments(pattern, uri []string) bool {
+	if len(pattern) == 0 {
+		return len(uri) == 0
+	}
+	if pattern[0] == "*" {
+		for i := 0; i <= len(uri); i++ {
+			if matchSegments(pattern[1:], uri[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(uri) == 0 || (pattern[0] != "+" && pattern[0] != uri[0]) {
+		return false
+	}
+	return matchSegments(pattern[1:], uri[1:])
+}
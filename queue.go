@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+var queueBucket = []byte("outbound")
+
+var errQueueFull = errors.New("Outbound queue is full")
+
+// a message waiting to be published on BOSSWAVE
+type queuedMessage struct {
+	VK  string
+	URI string
+	POs []queuedPO
+}
+
+type queuedPO struct {
+	PONum    int
+	Contents []byte
+}
+
+// Persistent FIFO of messages that could not be published because BOSSWAVE
+// was unreachable. While the queue has a backlog, all new messages are
+// appended to it rather than published directly so that messages on the
+// same URI are delivered in the order they were received
+type outboundQueue struct {
+	db        *bolt.DB
+	publisher Publisher
+	maxSize   int
+	// how long to wait before retrying after a failed replay
+	retry time.Duration
+	// number of messages in the queue
+	count int
+	// false while we are buffering
+	online bool
+	// signals the replay loop that there is something in the queue
+	wake chan struct{}
+	// when we last published a message, directly or from the queue
+	lastPublished time.Time
+	// uri -> held while a message is published on it, so that concurrent
+	// reports for the same URI can't overtake each other
+	uris map[string]*sync.Mutex
+	sync.Mutex
+}
+
+// opens the queue at the given filename and starts replaying any messages
+// left over from a previous run
+func newQueue(filename string, maxSize int, retry time.Duration, publisher Publisher) (*outboundQueue, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open queue file")
+	}
+	q := &outboundQueue{
+		db:        db,
+		publisher: publisher,
+		maxSize:   maxSize,
+		retry:     retry,
+		wake:      make(chan struct{}, 1),
+		uris:      make(map[string]*sync.Mutex),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(queueBucket)
+		if err != nil {
+			return errors.Wrap(err, "Could not create queue bucket")
+		}
+		q.count = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.online = q.count == 0
+	if q.count > 0 {
+		log.Warningf("Replaying %d buffered messages", q.count)
+	}
+	go q.replay()
+	return q, nil
+}
+
+// Publishes the payload objects on the given URI, or buffers them if BOSSWAVE
+// is unreachable or there are older messages still waiting in the queue.
+// Returns true if the message was buffered instead of published
+func (q *outboundQueue) publish(vk string, uri string, pos ...bw2.PayloadObject) (bool, error) {
+	// held until the message is either published or queued
+	uriLock := q.uriLock(uri)
+	uriLock.Lock()
+	defer uriLock.Unlock()
+
+	q.Lock()
+	if !q.online || q.count > 0 {
+		err := q.enqueue(vk, uri, pos)
+		q.Unlock()
+		return err == nil, err
+	}
+	q.Unlock()
+
+	err := q.publisher.Publish(vk, uri, pos...)
+	if err == nil {
+		q.published()
+		return false, nil
+	}
+	// only buffer if we can't reach the router; otherwise the message
+	// itself is the problem and retrying won't help
+	if errors.Cause(err) != errAgentUnavailable {
+		return false, err
+	}
+	log.Warningf("BOSSWAVE unreachable (%s); buffering messages", err)
+	q.Lock()
+	defer q.Unlock()
+	q.online = false
+	if err := q.enqueue(vk, uri, pos); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// returns the lock for publishing on the uri. There is one per URI we have
+// published on, which is bounded by the number of timeseries
+func (q *outboundQueue) uriLock(uri string) *sync.Mutex {
+	q.Lock()
+	defer q.Unlock()
+	lock, found := q.uris[uri]
+	if !found {
+		lock = &sync.Mutex{}
+		q.uris[uri] = lock
+	}
+	return lock
+}
+
+// records that we just published a message
+func (q *outboundQueue) published() {
+	q.Lock()
+	defer q.Unlock()
+	q.lastPublished = time.Now()
+}
+
+// returns the state of the queue for health checks: the number of messages
+// waiting, whether we are buffering, and when we last published a message
+func (q *outboundQueue) status() (size int, buffering bool, lastPublished time.Time) {
+	q.Lock()
+	defer q.Unlock()
+	return q.count, !q.online, q.lastPublished
+}
+
+// returns the number of messages waiting in the queue
+func (q *outboundQueue) size() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.count
+}
+
+// appends a message to the queue. Must be called with the lock held
+func (q *outboundQueue) enqueue(vk, uri string, pos []bw2.PayloadObject) error {
+	if q.count >= q.maxSize {
+		return errQueueFull
+	}
+	msg := queuedMessage{VK: vk, URI: uri}
+	for _, po := range pos {
+		msg.POs = append(msg.POs, queuedPO{PONum: po.GetPONum(), Contents: po.GetContents()})
+	}
+	value, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode message")
+	}
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(queueBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// big-endian keys keep the bucket in insertion order
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, value)
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not buffer message")
+	}
+	q.count += 1
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// returns the oldest message in the queue and its key, or nil if the queue is empty
+func (q *outboundQueue) peek() (key []byte, msg *queuedMessage, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(queueBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		key = append([]byte{}, k...)
+		msg = new(queuedMessage)
+		return json.Unmarshal(v, msg)
+	})
+	return
+}
+
+func (q *outboundQueue) remove(key []byte) error {
+	q.Lock()
+	defer q.Unlock()
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(queueBucket).Delete(key)
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not remove message from queue")
+	}
+	q.count -= 1
+	return nil
+}
+
+// publishes queued messages in FIFO order, waiting and retrying while
+// BOSSWAVE is unreachable. Once the queue is drained, we go back to
+// publishing directly
+func (q *outboundQueue) replay() {
+	for {
+		key, msg, err := q.peek()
+		if err != nil {
+			log.Error(errors.Wrap(err, "Could not read from queue"))
+			if key != nil {
+				q.remove(key)
+			} else {
+				time.Sleep(q.retry)
+			}
+			continue
+		}
+		if msg == nil {
+			q.Lock()
+			if q.count == 0 && !q.online {
+				log.Notice("Outbound queue drained")
+				q.online = true
+			}
+			q.Unlock()
+			<-q.wake
+			continue
+		}
+
+		var pos []bw2.PayloadObject
+		for _, po := range msg.POs {
+			pos = append(pos, bw2.CreateBasePayloadObject(po.PONum, po.Contents))
+		}
+		err = q.publisher.Publish(msg.VK, msg.URI, pos...)
+		if err == nil {
+			q.published()
+		} else if errors.Cause(err) == errAgentUnavailable {
+			time.Sleep(q.retry)
+			continue
+		} else {
+			log.Error(errors.Wrapf(err, "Dropping buffered message for %s", msg.URI))
+		}
+		if err := q.remove(key); err != nil {
+			log.Error(err)
+			time.Sleep(q.retry)
+		}
+	}
+}
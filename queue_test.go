@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+func newTestQueue(t *testing.T, maxSize int, publisher Publisher) *outboundQueue {
+	q, err := newQueue(filepath.Join(t.TempDir(), "queue.db"), maxSize, 10*time.Millisecond, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func textPO(text string) bw2.PayloadObject {
+	return bw2.CreateBasePayloadObject(1, []byte(text))
+}
+
+// the contents of the messages published on the uri, in order
+func publishedTexts(p *memoryPublisher, uri string) []string {
+	var texts []string
+	for _, msg := range publishedOn(p, uri) {
+		texts = append(texts, string(msg.POs[0].GetContents()))
+	}
+	return texts
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueueReplaysInOrder(t *testing.T) {
+	publisher := newMemoryPublisher()
+	q := newTestQueue(t, 10, publisher)
+
+	publisher.setOffline(true)
+	uris := []string{"scratch.ns/a", "scratch.ns/b"}
+	var expected = make(map[string][]string)
+	for i := 0; i < 6; i++ {
+		uri := uris[i%2]
+		text := fmt.Sprintf("%d", i)
+		buffered, err := q.publish("vk", uri, textPO(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !buffered {
+			t.Fatalf("Message %d was not buffered while offline", i)
+		}
+		expected[uri] = append(expected[uri], text)
+	}
+	if size := q.size(); size != 6 {
+		t.Fatalf("Queue has %d messages, expected 6", size)
+	}
+
+	// new messages go behind the backlog, even once we are back online
+	publisher.setOffline(false)
+	if buffered, err := q.publish("vk", uris[0], textPO("6")); err != nil || !buffered {
+		t.Errorf("Message behind the backlog: buffered %v, error %v", buffered, err)
+	}
+	expected[uris[0]] = append(expected[uris[0]], "6")
+
+	waitFor(t, "the queue to drain", func() bool {
+		_, buffering, _ := q.status()
+		return !buffering
+	})
+	for _, uri := range uris {
+		if texts := publishedTexts(publisher, uri); fmt.Sprint(texts) != fmt.Sprint(expected[uri]) {
+			t.Errorf("Replayed %v on %s, expected %v", texts, uri, expected[uri])
+		}
+	}
+	if buffered, err := q.publish("vk", uris[0], textPO("7")); err != nil || buffered {
+		t.Errorf("Message after draining: buffered %v, error %v", buffered, err)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	publisher := newMemoryPublisher()
+	publisher.setOffline(true)
+	q := newTestQueue(t, 2, publisher)
+	for i := 0; i < 2; i++ {
+		if _, err := q.publish("vk", "scratch.ns/a", textPO("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.publish("vk", "scratch.ns/a", textPO("x")); err != errQueueFull {
+		t.Errorf("Expected errQueueFull, got %v", err)
+	}
+}
+
+// holds up the first Publish until released
+type gatedPublisher struct {
+	*memoryPublisher
+	entered chan struct{}
+	release chan struct{}
+	gated   int32
+}
+
+func (p *gatedPublisher) Publish(vk, uri string, pos ...bw2.PayloadObject) error {
+	if atomic.CompareAndSwapInt32(&p.gated, 0, 1) {
+		close(p.entered)
+		<-p.release
+	}
+	return p.memoryPublisher.Publish(vk, uri, pos...)
+}
+
+func TestQueueKeepsOrderPerURI(t *testing.T) {
+	publisher := &gatedPublisher{
+		memoryPublisher: newMemoryPublisher(),
+		entered:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	q := newTestQueue(t, 10, publisher)
+	uri := "scratch.ns/a"
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		q.publish("vk", uri, textPO("first"))
+	}()
+	<-publisher.entered
+	go func() {
+		defer wg.Done()
+		q.publish("vk", uri, textPO("second"))
+	}()
+	// other URIs aren't held up
+	go func() {
+		defer wg.Done()
+		q.publish("vk", "scratch.ns/b", textPO("other"))
+	}()
+	waitFor(t, "the other URI", func() bool {
+		return len(publishedOn(publisher.memoryPublisher, "scratch.ns/b")) == 1
+	})
+	time.Sleep(50 * time.Millisecond)
+	if texts := publishedTexts(publisher.memoryPublisher, uri); len(texts) != 0 {
+		t.Errorf("Published %v while the first message was still being sent", texts)
+	}
+	close(publisher.release)
+	wg.Wait()
+	if texts := publishedTexts(publisher.memoryPublisher, uri); fmt.Sprint(texts) != "[first second]" {
+		t.Errorf("Published %v, expected [first second]", texts)
+	}
+}
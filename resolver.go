@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// names of the resolvers that can be chained with --resolvers
+const (
+	hodResolverName      = "hod"
+	fileResolverName     = "file"
+	metadataResolverName = "metadata"
+)
+
+// Maps a sMAP timeseries to the Brick point and equipment it belongs to. Only
+// Name, Class, Equipment and EquipmentClass are filled in; the generic
+// classes are worked out by the server
+type PointResolver interface {
+	// returns nil if the resolver knows nothing about the point
+	Resolve(msg SmapMessage) (*pointInfo, error)
+}
+
+// tries each resolver in order and returns the first result. A resolver that
+// fails is skipped; its error is only returned if no later resolver knows
+// the point
+type resolverChain []PointResolver
+
+func (chain resolverChain) Resolve(msg SmapMessage) (*pointInfo, error) {
+	var lastErr error
+	for _, r := range chain {
+		info, err := r.Resolve(msg)
+		if err != nil {
+			log.Warningf("Could not resolve %s: %s", msg.UUID, err)
+			lastErr = err
+			continue
+		}
+		if info != nil {
+			return info, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// returns an error if any of the names isn't a known resolver
+func checkResolvers(names []string) error {
+	if len(names) == 0 {
+		return errors.New("Need at least one resolver")
+	}
+	for _, name := range names {
+		switch name {
+		case hodResolverName, fileResolverName, metadataResolverName, modelResolverName:
+		default:
+			return errors.Errorf("Unknown resolver %s (expected %s, %s, %s or %s)", name, hodResolverName, fileResolverName, modelResolverName, metadataResolverName)
+		}
+	}
+	return nil
+}
+
+// builds the chain of resolvers with the given names, in order
+func newResolverChain(names []string, client *hodConn, mappingFile string, model *brickModel) (resolverChain, error) {
+	if err := checkResolvers(names); err != nil {
+		return nil, err
+	}
+	var chain resolverChain
+	for _, name := range names {
+		switch name {
+		case hodResolverName:
+			chain = append(chain, &hodResolver{client: client})
+		case fileResolverName:
+			if mappingFile == "" {
+				return nil, errors.New("The file resolver needs a mapping file (--mapping)")
+			}
+			r, err := newFileResolver(mappingFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, r)
+		case metadataResolverName:
+			chain = append(chain, metadataResolver{})
+		case modelResolverName:
+			if model == nil {
+				return nil, errors.New("The model resolver needs a Brick model file (--model)")
+			}
+			chain = append(chain, model)
+		}
+	}
+	return chain, nil
+}
+
+// queries Hod for the point and equipment associated with the UUID
+type hodResolver struct {
+	client *hodConn
+}
+
+func (r *hodResolver) Resolve(msg SmapMessage) (*pointInfo, error) {
+	query := fmt.Sprintf(`SELECT ?name ?class ?equip ?equipclass WHERE {
+            ?name bf:uuid "%s" .
+            ?name rdf:type ?class .
+            {
+                ?name bf:isPointOf ?equip .
+                OR
+                ?name bf:isPartOf ?equip .
+            }
+            ?equip rdf:type ?equipclass .
+        };`, msg.UUID)
+	start := time.Now()
+	res, err := r.client.DoQuery(query, nil)
+	hodQueryDuration.WithLabelValues("resolve").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Rows) == 0 {
+		return nil, nil
+	}
+
+	row := res.Rows[0]
+	return &pointInfo{
+		Name:           row["?name"].Value,
+		Class:          row["?class"].Value,
+		Equipment:      row["?equip"].Value,
+		EquipmentClass: row["?equipclass"].Value,
+	}, nil
+}
+
+// Looks UUIDs up in a mapping file. A .csv file has the columns
+//
+//	uuid,name,class,equipment,equipmentclass
+//
+// with an optional header row. A .json file is an object keyed by UUID:
+//
+//	{"<uuid>": {"Name": ..., "Class": ..., "Equipment": ..., "EquipmentClass": ...}}
+type fileResolver struct {
+	points map[string]pointInfo
+}
+
+func newFileResolver(filename string) (*fileResolver, error) {
+	var (
+		points map[string]pointInfo
+		err    error
+	)
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		points, err = loadCSVMapping(filename)
+	case ".json":
+		points, err = loadJSONMapping(filename)
+	default:
+		return nil, errors.Errorf("Mapping file %s must be .csv or .json", filename)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not load mapping file %s", filename)
+	}
+	log.Noticef("Loaded %d points from %s", len(points), filename)
+	return &fileResolver{points: points}, nil
+}
+
+func loadCSVMapping(filename string) (map[string]pointInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 5
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var points = make(map[string]pointInfo)
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "uuid") {
+			continue
+		}
+		points[record[0]] = pointInfo{
+			Name:           record[1],
+			Class:          record[2],
+			Equipment:      record[3],
+			EquipmentClass: record[4],
+		}
+	}
+	return points, nil
+}
+
+func loadJSONMapping(filename string) (map[string]pointInfo, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var points map[string]pointInfo
+	if err := json.Unmarshal(contents, &points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (r *fileResolver) Resolve(msg SmapMessage) (*pointInfo, error) {
+	info, found := r.points[msg.UUID]
+	if !found {
+		return nil, nil
+	}
+	// info is a copy, so the server can fill in the generic classes; those
+	// always come from the taxonomy, not from the file
+	info.GenericClass, info.GenericEquipClass, info.EquipInterface = "", "", ""
+	return &info, nil
+}
+
+// Takes the point from the sMAP Metadata of the timeseries, e.g.
+//
+//	"Metadata": {"Brick": {"Class": "Zone_Temperature_Sensor", "Equipment": "VAV_1", ...}}
+//
+// The name defaults to the sMAP path. Timeseries without a Brick class are
+// left to the next resolver
+type metadataResolver struct{}
+
+func (metadataResolver) Resolve(msg SmapMessage) (*pointInfo, error) {
+	get := func(key string) string {
+		if v, ok := msg.Metadata["Brick."+key].(string); ok {
+			return v
+		}
+		return ""
+	}
+	info := &pointInfo{
+		Name:           get("Name"),
+		Class:          get("Class"),
+		Equipment:      get("Equipment"),
+		EquipmentClass: get("EquipmentClass"),
+	}
+	if info.Class == "" {
+		return nil, nil
+	}
+	if info.Name == "" {
+		info.Name = msg.Path
+	}
+	return info, nil
+}
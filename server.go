@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"goji.io"
+	"goji.io/pat"
+	"goji.io/pattern"
+)
+
+type server struct {
+	mux         *goji.Mux
+	hod         *hodConn
+	store       *entityStore
+	publisher   Publisher
+	queue       *outboundQueue
+	resolver    PointResolver
+	cache       *resolutionCache
+	unresolved  *unresolvedTracker
+	classes     *classIndex
+	metadata    *metadataTracker
+	actuators   *actuationBridge
+	signals     *signalNamer
+	interfaces  *interfaceRegistry
+	cfg         serverConfig
+	sources     map[string]*source
+	sourcesLock sync.RWMutex
+}
+
+// options for the server, as given on the command line
+type serverConfig struct {
+	address string
+	pidfile string
+	// Unix domain socket for the admin API
+	adminSocket string
+	hodURI      string
+	entity      string
+	taxonomy    taxonomy
+	// how to name the signal of each point, and names for specific classes
+	signalNaming string
+	signalNames  map[string]string
+	// names of the resolvers to try, in order
+	resolvers []string
+	// CSV or JSON file for the file resolver
+	mappingFile string
+	// Brick model (Turtle files) for the model resolver and the class index
+	modelFiles []string
+	// URI template for reports sent to /add/<vk>/uri/<base uri>
+	uriTemplate string
+	// URI template for unresolved timeseries; empty to drop them
+	fallbackTemplate string
+	// YAML file describing the sources; optional
+	configFile string
+	// if true, publish all readings of a message as one BatchMessage
+	batch bool
+	// all published timestamps are converted to this unit
+	timeUnit         UnitOfTime
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	classRefresh     time.Duration
+	// warn about entities that expire within this window
+	expiryWarning time.Duration
+}
+
+// returns true if we need a Hod client: to resolve points, or to classify
+// them if there is no local model
+func (cfg serverConfig) usesHod() bool {
+	if len(cfg.modelFiles) == 0 {
+		return true
+	}
+	for _, name := range cfg.resolvers {
+		if name == hodResolverName {
+			return true
+		}
+	}
+	return false
+}
+
+func startServer(cfg serverConfig, store *entityStore, publisher Publisher, queue *outboundQueue) {
+	var (
+		f   *os.File
+		err error
+	)
+	// write the PID to the file
+	pid := os.Getpid()
+
+	if f, err = os.Create(cfg.pidfile); err != nil {
+		log.Fatal(errors.Wrap(err, "Cannot write PID file"))
+	} else if _, err = f.WriteString(fmt.Sprintf("%d", pid)); err != nil {
+		log.Fatal(errors.Wrap(err, "Cannot write PID file"))
+	}
+	if err = f.Close(); err != nil {
+		log.Fatal(errors.Wrap(err, "Cannot write PID file"))
+	}
+
+	s := &server{
+		mux:        goji.NewMux(),
+		store:      store,
+		publisher:  publisher,
+		queue:      queue,
+		cfg:        cfg,
+		cache:      newResolutionCache(cfg.cacheTTL, cfg.negativeCacheTTL),
+		unresolved: newUnresolvedTracker(),
+		metadata:   newMetadataTracker(),
+		actuators:  newActuationBridge(publisher),
+		interfaces: newInterfaceRegistry(),
+	}
+
+	registerQueueDepth(queue)
+
+	if s.signals, err = newSignalNamer(cfg.signalNaming, cfg.signalNames, signalsFile); err != nil {
+		log.Fatal(err)
+	}
+
+	var model *brickModel
+	if len(cfg.modelFiles) > 0 {
+		if model, err = newBrickModel(cfg.modelFiles); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// define Hod client; this uses the server's own entity.
+	// Readings are published using the entity registered for each VK
+	if cfg.usesHod() {
+		// wait for the agent rather than exiting; sMAP drivers keep their
+		// reports until they can deliver them
+		if s.hod, err = newHodConn(store.agent, cfg.entity, cfg.hodURI); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if s.resolver, err = newResolverChain(cfg.resolvers, s.hod, cfg.mappingFile, model); err != nil {
+		log.Fatal(err)
+	}
+
+	// load the subclass closure for the generic classes and keep it fresh;
+	// the local model takes the place of Hod if we have one
+	var classes classSource = hodClassSource{client: s.hod}
+	if model != nil {
+		classes = model
+	}
+	s.classes, err = newClassIndex(classes, cfg.taxonomy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if model != nil {
+		go model.watch(modelCheckInterval, func() {
+			if _, err := s.classes.load(); err != nil {
+				log.Error(errors.Wrap(err, "Could not refresh class index"))
+			}
+			// cached resolutions may be out of date
+			log.Notice("Brick model changed; purging resolution cache")
+			s.cache.purge()
+		})
+	}
+	go func() {
+		for _ = range time.Tick(cfg.classRefresh) {
+			changed, err := s.classes.load()
+			if err != nil {
+				log.Error(errors.Wrap(err, "Could not refresh class index"))
+			} else if changed {
+				// cached generic classes may be out of date
+				log.Notice("Class index changed; purging resolution cache")
+				s.cache.purge()
+			}
+		}
+	}()
+
+	if cfg.configFile != "" {
+		if err := s.loadSources(); err != nil {
+			log.Fatal(err)
+		}
+		s.reloadOnSignal()
+	}
+
+	if err := s.serveAdmin(cfg.adminSocket); err != nil {
+		log.Fatal(err)
+	}
+
+	go s.watchExpiry(cfg.expiryWarning)
+
+	s.mux.HandleFunc(pat.Post("/add/:vk/uri/*"), s.add)
+	s.mux.HandleFunc(pat.Post("/add/:source"), s.addSource)
+	s.mux.HandleFunc(pat.Delete("/cache"), s.purgeCache)
+	s.mux.HandleFunc(pat.Delete("/cache/:uuid"), s.invalidateCache)
+	s.mux.HandleFunc(pat.Get("/unresolved"), s.listUnresolved)
+	s.mux.HandleFunc(pat.Get("/interfaces"), s.listInterfaces)
+	s.mux.Handle(pat.Get("/metrics"), promhttp.Handler())
+	s.mux.HandleFunc(pat.Get("/healthz"), s.healthz)
+	s.mux.HandleFunc(pat.Get("/readyz"), s.readyz)
+	log.Noticef("Serving on %s...", cfg.address)
+	log.Fatal(http.ListenAndServe(cfg.address, s.mux))
+}
+
+// handles reports sent to /add/<vk>/uri/<base uri>
+func (s *server) add(w http.ResponseWriter, r *http.Request) {
+	// extract the VK and path from the URI
+	vk := pat.Param(r, "vk")
+	baseuri := strings.Trim(pattern.Path(r.Context()), "/")
+	if err := checkURI(baseuri); err != nil {
+		r.Body.Close()
+		http.Error(w, fmt.Sprintf("Invalid base URI: %s", err), 400)
+		return
+	}
+	s.report(w, r, &source{
+		vk:         vk,
+		baseuri:    baseuri,
+		template:   s.cfg.uriTemplate,
+		fallback:   s.cfg.fallbackTemplate,
+		timeUnit:   s.cfg.timeUnit,
+		resolution: resolveHod,
+		batch:      s.cfg.batch,
+	})
+}
+
+// handles reports sent to /add/<source name> for sources in the config file
+func (s *server) addSource(w http.ResponseWriter, r *http.Request) {
+	name := pat.Param(r, "source")
+	src := s.getSource(name)
+	if src == nil {
+		r.Body.Close()
+		http.Error(w, fmt.Sprintf("No source named %s", name), 404)
+		return
+	}
+	s.report(w, r, src)
+}
+
+// what happened to one timeseries in a report
+const (
+	// published on BOSSWAVE
+	statusPublished = "published"
+	// waiting in the outbound queue until BOSSWAVE is reachable
+	statusBuffered = "buffered"
+	// no resolver knew the UUID; published on the fallback URI if there is one
+	statusUnresolved = "unresolved"
+	// not published because of an error
+	statusRejected = "rejected"
+)
+
+// reported for each sMAP path in the response to a report
+type pathStatus struct {
+	Status string
+	URI    string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// forwards the sMAP messages in the request on behalf of the given source
+func (s *server) report(w http.ResponseWriter, r *http.Request, src *source) {
+	defer r.Body.Close()
+	// make sure we have an entity for the corresponding vk. Until then the
+	// labels are whatever the client put in the URL, so don't count anything
+	// by source yet
+	if !s.store.known(src.vk) {
+		errorsTotal.WithLabelValues(errorUnknownVK).Inc()
+		http.Error(w, fmt.Sprintf("No bw2 client found for vk %s", src.vk), 403)
+		return
+	}
+	reportsReceived.WithLabelValues(src.label(), src.baseuri).Inc()
+	s.store.markUsed(src.vk)
+
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		errorsTotal.WithLabelValues(errorDecode).Inc()
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// each path is handled on its own so that one bad timeseries doesn't make
+	// the driver resend (and us republish) all the others
+	var (
+		msgs      = make(TieredSmapMessage)
+		results   = make(map[string]pathStatus)
+		rejected  int
+		queueFull bool
+	)
+	for path, body := range raw {
+		var msg SmapMessage
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&msg); err != nil {
+			errorsTotal.WithLabelValues(errorDecode).Inc()
+			log.Warningf("Path %s of %s: %s", path, src.baseuri, err)
+			results[path] = pathStatus{Status: statusRejected, Error: err.Error()}
+			rejected += 1
+			continue
+		}
+		msgs[path] = &msg
+	}
+	// push metadata from collections down to the timeseries
+	msgs.CollapseToTimeseries()
+
+	for path, msg := range msgs {
+		metadataReceived.WithLabelValues(src.label(), src.baseuri).Add(float64(len(msg.Metadata)))
+		readingsReceived.WithLabelValues(src.label(), src.baseuri).Add(float64(len(msg.Readings)))
+
+		status, err := s.forward(src, *msg)
+		if err != nil {
+			status.Error = err.Error()
+			log.Warningf("Path %s of %s: %s", path, src.baseuri, err)
+		}
+		if status.Status == statusRejected {
+			rejected += 1
+			queueFull = queueFull || err == errQueueFull
+		}
+		results[path] = status
+		pathsForwarded.WithLabelValues(src.label(), src.baseuri, status.Status).Inc()
+	}
+
+	// only fail the request if nothing got through; then the driver can
+	// safely retry it
+	if len(results) > 0 && rejected == len(results) {
+		w.Header().Set("Content-Type", "application/json")
+		if queueFull {
+			w.WriteHeader(503)
+		} else {
+			w.WriteHeader(500)
+		}
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// drops all cached UUID resolutions
+func (s *server) purgeCache(w http.ResponseWriter, r *http.Request) {
+	s.cache.purge()
+	log.Notice("Purged resolution cache")
+	w.WriteHeader(200)
+}
+
+// drops the cached resolution for a single UUID
+func (s *server) invalidateCache(w http.ResponseWriter, r *http.Request) {
+	uuid := pat.Param(r, "uuid")
+	s.cache.invalidate(uuid)
+	log.Noticef("Invalidated cached resolution for %s", uuid)
+	w.WriteHeader(200)
+}
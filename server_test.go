@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"goji.io"
+	"goji.io/pat"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+const testVK = "testvk="
+
+// answers subclass queries from a fixed map instead of Hod
+type staticClasses map[string][]string
+
+func (c staticClasses) subclassesOf(class string) ([]string, error) {
+	return c[class], nil
+}
+
+// a server that publishes to a memoryPublisher and resolves points from
+// their sMAP Metadata, so no router or Hod is needed
+func newTestServer(t *testing.T) (*server, *memoryPublisher, *goji.Mux) {
+	dir := t.TempDir()
+	store := newStore(filepath.Join(dir, "entities.db"), "", 1)
+	store.conns.addEntity(testVK, nil)
+	publisher := newMemoryPublisher()
+	queue, err := newQueue(filepath.Join(dir, "queue.db"), 10, 10*time.Millisecond, publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals, err := newSignalNamer(signalByClass, defaultSignalNames, filepath.Join(dir, "signals.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes, err := newClassIndex(staticClasses{
+		"Sensor": {"Sensor", "Zone_Temperature_Sensor"},
+		"VAV":    {"VAV"},
+	}, defaultTaxonomy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		store:      store,
+		publisher:  publisher,
+		queue:      queue,
+		resolver:   resolverChain{metadataResolver{}},
+		cache:      newResolutionCache(time.Minute, time.Minute),
+		unresolved: newUnresolvedTracker(),
+		classes:    classes,
+		metadata:   newMetadataTracker(),
+		actuators:  newActuationBridge(publisher),
+		signals:    signals,
+		interfaces: newInterfaceRegistry(),
+		cfg: serverConfig{
+			uriTemplate:  brickTemplate,
+			signalNaming: signalByClass,
+			timeUnit:     UOT_NS,
+		},
+	}
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Post("/add/:vk/uri/*"), s.add)
+	return s, publisher, mux
+}
+
+const testReport = `{
+	"/": {"Metadata": {"Location": {"Building": "Soda"}}},
+	"/vav1/temp": {
+		"uuid": "b8b8c55e-2a5b-11e7-93ae-92361f002671",
+		"Properties": {"UnitofTime": "ms", "StreamType": "numeric"},
+		"Metadata": {"Brick": {"Name": "VAV1_ZNT", "Class": "Zone_Temperature_Sensor", "Equipment": "VAV1", "EquipmentClass": "VAV"}},
+		"Readings": [[1500000000000, 72.5]]
+	}
+}`
+
+func postReport(mux *goji.Mux, url, body string) (*httptest.ResponseRecorder, map[string]pathStatus) {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", url, strings.NewReader(body)))
+	var results map[string]pathStatus
+	json.Unmarshal(w.Body.Bytes(), &results)
+	return w, results
+}
+
+// returns the messages published on the uri
+func publishedOn(p *memoryPublisher, uri string) []recordedMessage {
+	var msgs []recordedMessage
+	for _, msg := range p.published() {
+		if msg.URI == uri {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+func decodePO(t *testing.T, po bw2.PayloadObject, v interface{}) {
+	mp, err := bw2.LoadMsgPackPayloadObject(po.GetPONum(), po.GetContents())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.ValueInto(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddPublishesResolvedPoint(t *testing.T) {
+	_, publisher, mux := newTestServer(t)
+	w, results := postReport(mux, "/add/"+testVK+"/uri/scratch.ns/soda", testReport)
+	if w.Code != 200 {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+	}
+	uri := "scratch.ns/soda/s.bms/VAV1/i.VAV/signal/zone_temp"
+	if status := results["/vav1/temp"]; status.Status != statusPublished || status.URI != uri {
+		t.Fatalf("Unexpected result %+v", status)
+	}
+
+	msgs := publishedOn(publisher, uri)
+	if len(msgs) != 1 || len(msgs[0].POs) != 1 {
+		t.Fatalf("Expected one message on %s, got %+v", uri, msgs)
+	}
+	if msgs[0].VK != testVK {
+		t.Errorf("Published as %s, expected %s", msgs[0].VK, testVK)
+	}
+	var dm DataMessage
+	decodePO(t, msgs[0].POs[0], &dm)
+	expected := DataMessage{
+		Time:           1500000000000000000,
+		Value:          72.5,
+		Name:           "VAV1_ZNT",
+		Class:          "Sensor",
+		Equipment:      "VAV1",
+		EquipmentClass: "VAV",
+	}
+	if dm != expected {
+		t.Errorf("Published %+v, expected %+v", dm, expected)
+	}
+
+	md := publisher.persisted(uri)
+	if md["Metadata.Location.Building"] != "Soda" || md["Brick.Class"] != "Zone_Temperature_Sensor" {
+		t.Errorf("Unexpected metadata %v", md)
+	}
+	if descriptors := publishedOn(publisher, "scratch.ns/soda/s.bms/VAV1/i.VAV/descriptor"); len(descriptors) != 1 || !descriptors[0].Persisted {
+		t.Errorf("Expected one persisted interface descriptor, got %+v", descriptors)
+	}
+}
+
+func TestForwardOnPath(t *testing.T) {
+	s, publisher, _ := newTestServer(t)
+	src := &source{
+		vk:         testVK,
+		baseuri:    "scratch.ns/weather",
+		template:   pathTemplate,
+		resolution: resolvePath,
+		timeUnit:   UOT_S,
+	}
+	var msgs TieredSmapMessage
+	dec := json.NewDecoder(strings.NewReader(testReport))
+	dec.UseNumber()
+	if err := dec.Decode(&msgs); err != nil {
+		t.Fatal(err)
+	}
+	msgs.CollapseToTimeseries()
+
+	status, err := s.forward(src, *msgs["/vav1/temp"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := "scratch.ns/weather/vav1/temp"
+	if status.Status != statusPublished || status.URI != uri {
+		t.Fatalf("Unexpected result %+v", status)
+	}
+	published := publishedOn(publisher, uri)
+	if len(published) != 1 {
+		t.Fatalf("Expected one message on %s, got %d", uri, len(published))
+	}
+	var dm DataMessage
+	decodePO(t, published[0].POs[0], &dm)
+	if dm.Time != 1500000000 || dm.Name != "/vav1/temp" {
+		t.Errorf("Unexpected message %+v", dm)
+	}
+}
+
+func TestForwardRejectsEmptyPlaceholder(t *testing.T) {
+	s, publisher, _ := newTestServer(t)
+	src := &source{
+		vk:         testVK,
+		baseuri:    "scratch.ns",
+		template:   "{base}/{Metadata.Location.Building}/{path}",
+		resolution: resolvePath,
+		timeUnit:   UOT_S,
+	}
+	msg := SmapMessage{
+		Path:     "/vav1/temp",
+		UUID:     "b8b8c55e-2a5b-11e7-93ae-92361f002671",
+		Metadata: map[string]interface{}{"Location.Building": ""},
+	}
+	status, err := s.forward(src, msg)
+	if err == nil || status.Status != statusRejected {
+		t.Fatalf("Expected the path to be rejected, got %+v (%v)", status, err)
+	}
+	if n := len(publisher.published()); n != 0 {
+		t.Errorf("Published %d messages", n)
+	}
+}
+
+func TestForwardSkipsNullReadings(t *testing.T) {
+	s, publisher, _ := newTestServer(t)
+	src := &source{
+		vk:         testVK,
+		baseuri:    "scratch.ns/weather",
+		template:   pathTemplate,
+		resolution: resolvePath,
+		timeUnit:   UOT_S,
+	}
+	var msg SmapMessage
+	if err := json.Unmarshal([]byte(`{"Path": "/vav1/temp", "uuid": "b8b8c55e-2a5b-11e7-93ae-92361f002671", "Readings": [[1500000000, null], [1500000001, 72.5]]}`), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.forward(src, msg); err != nil {
+		t.Fatal(err)
+	}
+	published := publishedOn(publisher, "scratch.ns/weather/vav1/temp")
+	if len(published) != 1 {
+		t.Fatalf("Expected one message, got %d", len(published))
+	}
+	var dm DataMessage
+	decodePO(t, published[0].POs[0], &dm)
+	if dm.Time != 1500000001 || dm.Value != 72.5 {
+		t.Errorf("Unexpected message %+v", dm)
+	}
+}
+
+func TestForwardUnresolved(t *testing.T) {
+	s, publisher, _ := newTestServer(t)
+	msg := SmapMessage{
+		Path:     "/vav1/temp",
+		UUID:     "b8b8c55e-2a5b-11e7-93ae-92361f002671",
+		Readings: []SmapReading{{Time: "1500000000", Value: []byte("72.5")}},
+	}
+	src := &source{
+		vk:         testVK,
+		baseuri:    "scratch.ns/soda",
+		template:   brickTemplate,
+		fallback:   fallbackTemplate,
+		resolution: resolveHod,
+		timeUnit:   UOT_S,
+	}
+	status, err := s.forward(src, msg)
+	uri := "scratch.ns/soda/s.smap/unmapped/b8b8c55e-2a5b-11e7-93ae-92361f002671"
+	if err != nil || status.Status != statusUnresolved || status.URI != uri {
+		t.Fatalf("Unexpected result %+v (%v)", status, err)
+	}
+	if n := len(publishedOn(publisher, uri)); n != 1 {
+		t.Errorf("Published %d messages on the fallback URI", n)
+	}
+
+	// without a fallback template, the path is rejected
+	src.fallback = ""
+	status, err = s.forward(src, msg)
+	if err == nil || status.Status != statusRejected {
+		t.Errorf("Expected the path to be rejected, got %+v (%v)", status, err)
+	}
+}
+
+func TestAddRejectsUnknownVK(t *testing.T) {
+	_, publisher, mux := newTestServer(t)
+	series := testutil.CollectAndCount(reportsReceived)
+	w, _ := postReport(mux, "/add/othervk=/uri/scratch.ns/soda", testReport)
+	if w.Code != 403 {
+		t.Errorf("Got status %d, expected 403", w.Code)
+	}
+	if n := len(publisher.published()); n != 0 {
+		t.Errorf("Published %d messages for an unknown VK", n)
+	}
+	// the labels come from the URL, so each request could add a series
+	if n := testutil.CollectAndCount(reportsReceived); n != series {
+		t.Errorf("Unknown VK added %d report series", n-series)
+	}
+}
+
+func TestAddRejectsMalformedPath(t *testing.T) {
+	_, publisher, mux := newTestServer(t)
+	report := strings.TrimSuffix(strings.TrimSpace(testReport), "}") + `,
+	"/vav1/bad": {"uuid": "c4b0d3a2-2a5b-11e7-93ae-92361f002671", "Readings": "not a list"}
+}`
+	w, results := postReport(mux, "/add/"+testVK+"/uri/scratch.ns/soda", report)
+	if w.Code != 200 {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+	}
+	if status := results["/vav1/bad"]; status.Status != statusRejected || status.Error == "" {
+		t.Errorf("Expected the malformed path to be rejected, got %+v", status)
+	}
+	if status := results["/vav1/temp"]; status.Status != statusPublished {
+		t.Errorf("Expected the good path to be published, got %+v", status)
+	}
+	if n := len(publishedOn(publisher, "scratch.ns/soda/s.bms/VAV1/i.VAV/signal/zone_temp")); n != 1 {
+		t.Errorf("Published %d messages for the good path", n)
+	}
+
+	w, _ = postReport(mux, "/add/"+testVK+"/uri/scratch.ns/soda", `{"/vav1/temp": `)
+	if w.Code != 400 {
+		t.Errorf("Got status %d for a malformed body, expected 400", w.Code)
+	}
+}
+
+func TestQueueBuffersWhileOffline(t *testing.T) {
+	s, publisher, mux := newTestServer(t)
+	uri := "scratch.ns/soda/s.bms/VAV1/i.VAV/signal/zone_temp"
+
+	publisher.setOffline(true)
+	w, results := postReport(mux, "/add/"+testVK+"/uri/scratch.ns/soda", testReport)
+	if w.Code != 200 {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body.String())
+	}
+	if status := results["/vav1/temp"]; status.Status != statusBuffered {
+		t.Fatalf("Expected the path to be buffered, got %+v", status)
+	}
+	if n := len(publishedOn(publisher, uri)); n != 0 {
+		t.Fatalf("Published %d messages while offline", n)
+	}
+	if size, buffering, _ := s.queue.status(); size != 1 || !buffering {
+		t.Fatalf("Expected one buffered message, got size %d (buffering %v)", size, buffering)
+	}
+
+	publisher.setOffline(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(publishedOn(publisher, uri)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Buffered message was not replayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var dm DataMessage
+	decodePO(t, publishedOn(publisher, uri)[0].POs[0], &dm)
+	if dm.Value != 72.5 {
+		t.Errorf("Replayed %+v", dm)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// how the signal segment of a point's URI is named
+const (
+	// from the point's Brick class, e.g. Zone_Temperature_Sensor -> zone_temperature_sensor
+	signalByClass = "class"
+	// from the point's generic class, e.g. sensor
+	signalByGeneric = "generic"
+	// from the point's Brick name
+	signalByName = "name"
+	// every point of an equipment shares signal/info, like before
+	signalInfo = "info"
+)
+
+// Brick classes with shorter signal names than the class scheme would give
+// them; used when the taxonomy file doesn't list any
+var defaultSignalNames = map[string]string{
+	"Zone_Temperature_Sensor":          "zone_temp",
+	"Zone_Temperature_Setpoint":        "zone_temp_setpoint",
+	"Supply_Air_Temperature_Sensor":    "supply_air_temp",
+	"Discharge_Air_Temperature_Sensor": "discharge_air_temp",
+	"Supply_Air_Flow_Sensor":           "supply_air_flow",
+	"Damper_Position_Command":          "damper_position",
+	"Occupancy_Sensor":                 "occupancy",
+}
+
+var unsafeSignalChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// returns an error if the naming scheme is unknown
+func checkSignalNaming(scheme string) error {
+	switch scheme {
+	case signalByClass, signalByGeneric, signalByName, signalInfo:
+		return nil
+	}
+	return fmt.Errorf("Unknown signal naming %q (must be %s, %s, %s or %s)", scheme, signalByClass, signalByGeneric, signalByName, signalInfo)
+}
+
+var signalsBucket = []byte("signals")
+
+// the signal name given to a point of an equipment
+type signalAssignment struct {
+	Equipment string
+	Point     string
+	// the name the scheme gave the point, before resolving collisions
+	Base   string
+	Signal string
+}
+
+// Names the signal of each point. Two points of the same equipment never get
+// the same name: the second one to arrive gets its point name appended, and
+// a counter if that is taken too. The
+// names are persisted so that a point keeps its signal across restarts and
+// no matter in which order the drivers report
+type signalNamer struct {
+	db     *bolt.DB
+	scheme string
+	// Brick class (point or generic) -> signal name, overriding the scheme
+	names map[string]string
+	// equipment -> point -> its signal
+	assigned map[string]map[string]signalAssignment
+	// equipment -> signal name -> the point that has it
+	taken map[string]map[string]string
+	sync.Mutex
+}
+
+// opens the file of persisted signal names and loads them
+func newSignalNamer(scheme string, names map[string]string, filename string) (*signalNamer, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open signals file")
+	}
+	n := &signalNamer{
+		db:       db,
+		scheme:   scheme,
+		names:    names,
+		assigned: make(map[string]map[string]signalAssignment),
+		taken:    make(map[string]map[string]string),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(signalsBucket)
+		if err != nil {
+			return errors.Wrap(err, "Could not create signals bucket")
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var a signalAssignment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return errors.Wrapf(err, "Could not decode signal of %s", k)
+			}
+			n.remember(a)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// returns the signal name for the point. equip identifies the equipment
+// across sources, e.g. the base URI and the equipment name
+func (n *signalNamer) name(equip string, info *pointInfo) string {
+	if n.scheme == signalInfo {
+		return "info"
+	}
+	base := n.baseName(info)
+
+	n.Lock()
+	defer n.Unlock()
+	// keep the name unless the scheme or the point's class changed
+	if a, found := n.assigned[equip][info.Name]; found && a.Base == base {
+		return a.Signal
+	}
+	signal := base
+	if !n.free(equip, signal, info.Name) {
+		signal = base + "_" + signalSegment(localName(info.Name))
+		// another point's scheme may have given it that name too
+		for i := 2; !n.free(equip, signal, info.Name); i++ {
+			signal = fmt.Sprintf("%s_%s_%d", base, signalSegment(localName(info.Name)), i)
+		}
+	}
+	a := signalAssignment{Equipment: equip, Point: info.Name, Base: base, Signal: signal}
+	n.remember(a)
+	// if this fails, the point may get another name after a restart
+	if err := n.persist(a); err != nil {
+		log.Error(err)
+	}
+	return signal
+}
+
+// returns true if no other point of the equipment has the signal name. Must
+// be called with the lock held
+func (n *signalNamer) free(equip, signal, point string) bool {
+	owner, found := n.taken[equip][signal]
+	return !found || owner == point
+}
+
+// records the assignment in memory, freeing the point's previous name. Must
+// be called with the lock held
+func (n *signalNamer) remember(a signalAssignment) {
+	if _, found := n.assigned[a.Equipment]; !found {
+		n.assigned[a.Equipment] = make(map[string]signalAssignment)
+		n.taken[a.Equipment] = make(map[string]string)
+	}
+	if prev, found := n.assigned[a.Equipment][a.Point]; found && n.taken[a.Equipment][prev.Signal] == a.Point {
+		delete(n.taken[a.Equipment], prev.Signal)
+	}
+	n.assigned[a.Equipment][a.Point] = a
+	n.taken[a.Equipment][a.Signal] = a.Point
+}
+
+func (n *signalNamer) persist(a signalAssignment) error {
+	value, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "Could not encode signal")
+	}
+	err = n.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(signalsBucket).Put([]byte(a.Equipment+"\x00"+a.Point), value)
+	})
+	return errors.Wrapf(err, "Could not save signal %s of %s", a.Signal, a.Point)
+}
+
+// the name according to the scheme, before resolving collisions
+func (n *signalNamer) baseName(info *pointInfo) string {
+	if name, found := n.names[localName(info.Class)]; found {
+		return name
+	}
+	if name, found := n.names[info.GenericClass]; found {
+		return name
+	}
+	var signal string
+	switch n.scheme {
+	case signalByClass:
+		signal = signalSegment(localName(info.Class))
+	case signalByGeneric:
+		signal = signalSegment(info.GenericClass)
+	case signalByName:
+		signal = signalSegment(localName(info.Name))
+	}
+	// e.g. points that were not resolved through Brick
+	if signal == "" {
+		signal = signalSegment(localName(info.Name))
+	}
+	return signal
+}
+
+// the name of a Brick entity without its namespace, or the last segment of a
+// sMAP path
+func localName(name string) string {
+	return name[strings.LastIndexAny(name, "#:/")+1:]
+}
+
+// lowercases the string and replaces everything that isn't a letter, digit
+// or underscore, so that it is a safe URI segment
+func signalSegment(s string) string {
+	s = unsafeSignalChars.ReplaceAllString(strings.ToLower(s), "_")
+	return strings.Trim(s, "_")
+}
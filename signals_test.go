@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSignalNames(t *testing.T) {
+	for _, test := range []struct {
+		scheme   string
+		info     pointInfo
+		expected string
+	}{
+		{signalByClass, pointInfo{Name: "soda#VAV1_ZNT", Class: "brick#Zone_Temperature_Sensor"}, "zone_temp"},
+		{signalByClass, pointInfo{Name: "soda#VAV1_DAT", Class: "brick#Discharge_Air_Static_Pressure"}, "discharge_air_static_pressure"},
+		{signalByGeneric, pointInfo{Name: "soda#VAV1_DAT", Class: "brick#Discharge_Air_Static_Pressure", GenericClass: "Sensor"}, "sensor"},
+		{signalByName, pointInfo{Name: "soda#VAV1_ZNT", Class: "brick#Zone_Temperature_Sensor"}, "zone_temp"},
+		{signalByName, pointInfo{Name: "soda#VAV1 ZN-T", Class: "brick#Discharge_Air_Static_Pressure"}, "vav1_zn_t"},
+		{signalByClass, pointInfo{Name: "/vav1/temp"}, "temp"},
+		{signalInfo, pointInfo{Name: "soda#VAV1_ZNT", Class: "brick#Zone_Temperature_Sensor"}, "info"},
+	} {
+		n, err := newSignalNamer(test.scheme, defaultSignalNames, filepath.Join(t.TempDir(), "signals.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signal := n.name("VAV1", &test.info); signal != test.expected {
+			t.Errorf("%s naming of %+v: got %s, expected %s", test.scheme, test.info, signal, test.expected)
+		}
+	}
+}
+
+func TestSignalNameCollisions(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "signals.db")
+	n, err := newSignalNamer(signalByClass, defaultSignalNames, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := []struct {
+		info     pointInfo
+		expected string
+	}{
+		{pointInfo{Name: "soda#p1", Class: "brick#Zone_Temperature_Sensor"}, "zone_temp"},
+		// its class gives the name the next point would get on a collision
+		{pointInfo{Name: "soda#p3", Class: "brick#Zone_Temp_P2"}, "zone_temp_p2"},
+		{pointInfo{Name: "soda#p2", Class: "brick#Zone_Temperature_Sensor"}, "zone_temp_p2_2"},
+		{pointInfo{Name: "soda#p4", Class: "brick#Zone_Temperature_Sensor"}, "zone_temp_p4"},
+	}
+	for _, p := range points {
+		if signal := n.name("VAV1", &p.info); signal != p.expected {
+			t.Errorf("Named %s %s, expected %s", p.info.Name, signal, p.expected)
+		}
+	}
+	// the same point of another equipment doesn't collide
+	if signal := n.name("VAV2", &points[2].info); signal != "zone_temp" {
+		t.Errorf("Named %s of VAV2 %s, expected zone_temp", points[2].info.Name, signal)
+	}
+
+	// after a restart, points keep their names whatever order they report in
+	n.db.Close()
+	n, err = newSignalNamer(signalByClass, defaultSignalNames, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		if signal := n.name("VAV1", &points[i].info); signal != points[i].expected {
+			t.Errorf("After reopening, named %s %s, expected %s", points[i].info.Name, signal, points[i].expected)
+		}
+	}
+}
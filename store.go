@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/immesys/bw2/objects"
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+var (
+	entityBucket = []byte("entity")
+	// maps VKs of rotated entities to the VK of the entity that replaced them
+	aliasBucket = []byte("alias")
+	// last time each VK was used to publish a report
+	lastUsedBucket = []byte("lastused")
+)
+
+// how often we persist the last-used times of entities
+const lastUsedFlushInterval = 1 * time.Minute
+
+var errUnknownVK = errors.New("No entity registered for vk")
+
+// stores our entities and lets us use them by VK through shared agent connections
+type entityStore struct {
+	filename string
+	// local file database that stores entities
+	db *bolt.DB
+	// router agent address
+	agent string
+	// connections to the agent, shared by all entities
+	conns *connManager
+	// old vk -> current vk for rotated entities
+	aliases map[string]string
+	// vk -> the entity file of a config source it was loaded from
+	files map[string]string
+	// vk -> last time it was used to publish a report
+	lastUsed     map[string]time.Time
+	lastUsedLock sync.Mutex
+	// VKs whose last-used time hasn't been written to the database yet
+	lastUsedDirty map[string]bool
+	sync.RWMutex
+}
+
+// details about a registered entity
+type entityInfo struct {
+	VK       string
+	Contact  string
+	Comment  string
+	Created  *time.Time `json:",omitempty"`
+	Expires  *time.Time `json:",omitempty"`
+	LastUsed *time.Time `json:",omitempty"`
+	// VKs of entities that were rotated to this one
+	Aliases []string `json:",omitempty"`
+	// the last error we got using the entity, if any
+	Error string `json:",omitempty"`
+	// the entity file it was loaded from, for entities of config sources
+	File string `json:",omitempty"`
+}
+
+// create a new entity store at the given filename, sharing the given number
+// of connections to the agent among all entities
+func newStore(filename, agent string, connections int) *entityStore {
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Could not open database file"))
+	}
+
+	s := &entityStore{
+		db:       db,
+		filename: filename,
+		agent:    agent,
+		conns:    newConnManager(agent, connections),
+		aliases:  make(map[string]string),
+		files:    make(map[string]string),
+
+		lastUsed:      make(map[string]time.Time),
+		lastUsedDirty: make(map[string]bool),
+	}
+
+	s.scanAndLoadVKs()
+	go s.flushLastUsed()
+	return s
+}
+
+func (s *entityStore) scanAndLoadVKs() {
+	s.Lock()
+	defer s.Unlock()
+	s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(entityBucket)
+		if err != nil {
+			return errors.Wrap(err, "Could not create entity bucket")
+		}
+		aliases, err := tx.CreateBucketIfNotExists(aliasBucket)
+		if err != nil {
+			return errors.Wrap(err, "Could not create alias bucket")
+		}
+		lastUsed, err := tx.CreateBucketIfNotExists(lastUsedBucket)
+		if err != nil {
+			return errors.Wrap(err, "Could not create last-used bucket")
+		}
+		// Loop through the bucket and hand each of the known keys to the
+		// connection manager. We don't talk to the agent here; an entity the
+		// agent rejects is reported when it is first used
+		b.ForEach(func(vk, contents []byte) error {
+			vk_string := base64.URLEncoding.EncodeToString(vk)
+			s.conns.addEntity(vk_string, contents)
+			log.Infof("Loaded vk %s", vk_string)
+			return nil
+		})
+		aliases.ForEach(func(oldvk, newvk []byte) error {
+			s.aliases[string(oldvk)] = string(newvk)
+			return nil
+		})
+		lastUsed.ForEach(func(vk, ts []byte) error {
+			var t time.Time
+			if err := t.UnmarshalBinary(ts); err == nil {
+				s.lastUsed[string(vk)] = t
+			}
+			return nil
+		})
+		return nil
+	})
+}
+
+// parses entity file contents (including the leading type byte). Returns the
+// vk and the contents without the type byte
+func parseEntity(contents []byte) ([]byte, []byte, error) {
+	if len(contents) == 0 {
+		return nil, nil, errors.New("Entity is empty")
+	}
+	fileType := contents[0]
+	contents = contents[1:]
+
+	// parse the contents of the file to extract the vk
+	ro, err := objects.NewEntity(int(fileType), contents)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not parse entity")
+	}
+	entity, ok := ro.(*objects.Entity)
+	if !ok {
+		return nil, nil, errors.New("Not an entity")
+	}
+	return entity.GetVK(), contents, nil
+}
+
+// Add entity from the given entity file contents (including the leading type byte).
+// The file contents get stored in the entity bucket with the public key (vk) as the key,
+// and we check that the agent accepts the entity.
+// Returns the vk of the key on success
+func (s *entityStore) addEntity(contents []byte) (string, error) {
+	vk, contents, err := parseEntity(contents)
+	if err != nil {
+		return "", err
+	}
+	vk_string := base64.URLEncoding.EncodeToString(vk)
+	if err := s.checkEntity(vk_string, contents); err != nil {
+		return "", err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(entityBucket)
+		if err != nil {
+			return errors.Wrap(err, "Could not create entity bucket")
+		}
+		return b.Put(vk, contents)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Could not store entity")
+	}
+
+	log.Noticef("Registered vk %s", vk_string)
+	return vk_string, nil
+}
+
+// Adds the entity to the connection manager and sets it on a connection to
+// make sure the agent accepts it. If the agent is down we keep the entity;
+// it will be checked again when it is first used
+func (s *entityStore) checkEntity(vk string, contents []byte) error {
+	s.conns.addEntity(vk, contents)
+	err := s.conns.do(vk, func(client *bw2.BW2Client) error { return nil })
+	if errors.Cause(err) == errAgentUnavailable {
+		log.Warningf("Could not check vk %s: %s", vk, err)
+		return nil
+	} else if err != nil {
+		s.conns.removeEntity(vk)
+		return err
+	}
+	return nil
+}
+
+// Removes the entity with the given vk and any aliases that point to it
+func (s *entityStore) removeEntity(vk string) error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.conns.has(vk) {
+		return errUnknownVK
+	}
+	vkbytes, err := base64.URLEncoding.DecodeString(vk)
+	if err != nil {
+		return errors.Wrap(err, "Invalid vk")
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(entityBucket).Delete(vkbytes); err != nil {
+			return err
+		}
+		for oldvk, newvk := range s.aliases {
+			if newvk == vk {
+				if err := tx.Bucket(aliasBucket).Delete([]byte(oldvk)); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(lastUsedBucket).Delete([]byte(vk))
+	})
+	if err != nil {
+		return errors.Wrap(err, "Could not remove entity")
+	}
+	s.conns.removeEntity(vk)
+	delete(s.files, vk)
+	for oldvk, newvk := range s.aliases {
+		if newvk == vk {
+			delete(s.aliases, oldvk)
+		}
+	}
+	s.lastUsedLock.Lock()
+	delete(s.lastUsed, vk)
+	delete(s.lastUsedDirty, vk)
+	s.lastUsedLock.Unlock()
+	log.Noticef("Removed vk %s", vk)
+	return nil
+}
+
+// Replaces the entity with the given vk by a new entity. Reports sent using
+// the old vk are published with the new entity from now on.
+// Returns the vk of the new entity
+func (s *entityStore) rotateEntity(oldvk string, contents []byte) (string, error) {
+	oldvk = s.resolveVK(oldvk)
+	if !s.conns.has(oldvk) {
+		return "", errUnknownVK
+	}
+	newvk, err := s.addEntity(contents)
+	if err != nil {
+		return "", err
+	}
+	if newvk == oldvk {
+		return newvk, nil
+	}
+	// carry over aliases of the old vk so they point to the new one
+	s.Lock()
+	var aliases = []string{oldvk}
+	for alias, target := range s.aliases {
+		if target == oldvk {
+			aliases = append(aliases, alias)
+		}
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, alias := range aliases {
+			if err := tx.Bucket(aliasBucket).Put([]byte(alias), []byte(newvk)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		for _, alias := range aliases {
+			s.aliases[alias] = newvk
+		}
+	}
+	s.Unlock()
+	if err != nil {
+		return "", errors.Wrap(err, "Could not store alias")
+	}
+	if err := s.removeEntity(oldvk); err != nil {
+		return "", err
+	}
+	log.Noticef("Rotated vk %s to %s", oldvk, newvk)
+	return newvk, nil
+}
+
+// returns the details of all registered entities and those loaded from the
+// entity files of config sources, sorted by VK
+func (s *entityStore) listEntities() ([]entityInfo, error) {
+	var infos []entityInfo
+	files := s.loadedFiles()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entityBucket).ForEach(func(vk, contents []byte) error {
+			info, err := s.describe(vk, contents)
+			if err != nil {
+				return err
+			}
+			info.File = files[info.VK]
+			delete(files, info.VK)
+			infos = append(infos, *info)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for vk, file := range files {
+		info, err := s.describeFile(vk, file)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			infos = append(infos, *info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].VK < infos[j].VK
+	})
+	return infos, err
+}
+
+// returns the details of the registered or loaded entity with the given vk
+func (s *entityStore) getEntity(vk string) (*entityInfo, error) {
+	vk = s.resolveVK(vk)
+	vkbytes, err := base64.URLEncoding.DecodeString(vk)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid vk")
+	}
+	file, loaded := s.loadedFiles()[vk]
+	var info *entityInfo
+	err = s.db.View(func(tx *bolt.Tx) error {
+		contents := tx.Bucket(entityBucket).Get(vkbytes)
+		if contents == nil {
+			return errUnknownVK
+		}
+		info, err = s.describe(vkbytes, contents)
+		return err
+	})
+	if err == errUnknownVK && loaded {
+		if info, err = s.describeFile(vk, file); err == nil && info == nil {
+			err = errUnknownVK
+		}
+	} else if err == nil {
+		info.File = file
+	}
+	return info, err
+}
+
+// returns a copy of the vk -> entity file map
+func (s *entityStore) loadedFiles() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	var files = make(map[string]string, len(s.files))
+	for vk, file := range s.files {
+		files[vk] = file
+	}
+	return files
+}
+
+// describes an entity loaded from a config source's entity file. Returns nil
+// if it has been removed since
+func (s *entityStore) describeFile(vk, file string) (*entityInfo, error) {
+	contents, found := s.conns.entity(vk)
+	if !found {
+		return nil, nil
+	}
+	vkbytes, err := base64.URLEncoding.DecodeString(vk)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid vk")
+	}
+	info, err := s.describe(vkbytes, contents)
+	if err != nil {
+		return nil, err
+	}
+	info.File = file
+	return info, nil
+}
+
+// parses the stored entity to fill in its details
+func (s *entityStore) describe(vk, contents []byte) (*entityInfo, error) {
+	vk_string := base64.URLEncoding.EncodeToString(vk)
+	// we store entities without the leading type byte
+	ro, err := objects.NewEntity(objects.ROEntityWKey, contents)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not parse stored entity %s", vk_string)
+	}
+	entity, ok := ro.(*objects.Entity)
+	if !ok {
+		return nil, errors.Errorf("Stored entity %s is not an entity", vk_string)
+	}
+	info := &entityInfo{
+		VK:      vk_string,
+		Contact: entity.GetContact(),
+		Comment: entity.GetComment(),
+		Created: entity.GetCreated(),
+		Expires: entity.GetExpiry(),
+	}
+	if err := s.conns.failure(vk_string); err != nil {
+		info.Error = err.Error()
+	}
+	s.lastUsedLock.Lock()
+	if t, found := s.lastUsed[vk_string]; found {
+		info.LastUsed = &t
+	}
+	s.lastUsedLock.Unlock()
+	s.RLock()
+	for oldvk, newvk := range s.aliases {
+		if newvk == vk_string {
+			info.Aliases = append(info.Aliases, oldvk)
+		}
+	}
+	s.RUnlock()
+	sort.Strings(info.Aliases)
+	return info, nil
+}
+
+// records that the entity with the given vk was just used to publish a report
+func (s *entityStore) markUsed(vk string) {
+	vk = s.resolveVK(vk)
+	s.lastUsedLock.Lock()
+	defer s.lastUsedLock.Unlock()
+	s.lastUsed[vk] = time.Now()
+	s.lastUsedDirty[vk] = true
+}
+
+// periodically writes last-used times to the database so they survive restarts
+func (s *entityStore) flushLastUsed() {
+	for _ = range time.Tick(lastUsedFlushInterval) {
+		s.lastUsedLock.Lock()
+		var dirty = make(map[string]time.Time)
+		for vk := range s.lastUsedDirty {
+			dirty[vk] = s.lastUsed[vk]
+		}
+		s.lastUsedDirty = make(map[string]bool)
+		s.lastUsedLock.Unlock()
+		if len(dirty) == 0 {
+			continue
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(lastUsedBucket)
+			for vk, t := range dirty {
+				ts, err := t.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(vk), ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error(errors.Wrap(err, "Could not store last-used times"))
+		}
+	}
+}
+
+// Makes the entity in the given file usable without storing the entity in
+// the database. Returns the vk of the entity
+func (s *entityStore) loadEntityFile(filename string) (string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not read entity file %s", filename)
+	}
+	vk, contents, err := parseEntity(contents)
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not load entity %s", filename)
+	}
+	vk_string := base64.URLEncoding.EncodeToString(vk)
+	if err := s.checkEntity(vk_string, contents); err != nil {
+		return "", errors.Wrapf(err, "Could not set entity %s", filename)
+	}
+	s.Lock()
+	s.files[vk_string] = filename
+	s.Unlock()
+	log.Infof("Loaded vk %s from %s", vk_string, filename)
+	return vk_string, nil
+}
+
+// Drops an entity that was loaded from a source's entity file, unless it was
+// also registered through the API
+func (s *entityStore) unloadEntity(vk string) {
+	s.Lock()
+	defer s.Unlock()
+	vkbytes, err := base64.URLEncoding.DecodeString(vk)
+	if err != nil {
+		return
+	}
+	delete(s.files, vk)
+	var registered bool
+	s.db.View(func(tx *bolt.Tx) error {
+		registered = tx.Bucket(entityBucket).Get(vkbytes) != nil
+		return nil
+	})
+	if registered || !s.conns.has(vk) {
+		return
+	}
+	s.conns.removeEntity(vk)
+	log.Noticef("Unloaded vk %s", vk)
+}
+
+// returns the vk of the entity that replaced the given vk, or the vk itself
+// if it hasn't been rotated
+func (s *entityStore) resolveVK(vk string) string {
+	s.RLock()
+	defer s.RUnlock()
+	if newvk, found := s.aliases[vk]; found {
+		return newvk
+	}
+	return vk
+}
+
+// returns true if we have an entity for the given vk (or one that replaced it)
+func (s *entityStore) known(vk string) bool {
+	return s.conns.has(s.resolveVK(vk))
+}
+
+// calls f with a client acting as the entity for the given vk. See connManager.do
+func (s *entityStore) do(vk string, f func(client *bw2.BW2Client) error) error {
+	return s.conns.do(s.resolveVK(vk), f)
+}
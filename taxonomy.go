@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// a generic class that Brick points and equipment are mapped to
+type genericClass struct {
+	// the Brick class (without namespace) that roots this generic class
+	Class string `yaml:"class"`
+	// the name used in the i.<interface> URI segment
+	Interface string `yaml:"interface"`
+	// classes with a lower precedence value are matched first
+	Precedence int `yaml:"precedence"`
+}
+
+// the set of generic classes, sorted by precedence
+type taxonomy []genericClass
+
+// used when no taxonomy file is given
+var defaultTaxonomy = taxonomy{
+	{Class: "Damper", Interface: "Damper", Precedence: 1},
+	{Class: "VAV", Interface: "VAV", Precedence: 2},
+	{Class: "Sensor", Interface: "Sensor", Precedence: 3},
+	{Class: "Command", Interface: "Command", Precedence: 4},
+	{Class: "Setpoint", Interface: "Setpoint", Precedence: 5},
+	{Class: "Status", Interface: "Status", Precedence: 6},
+}
+
+type taxonomyFile struct {
+	Classes taxonomy `yaml:"classes"`
+	// Brick class -> signal name
+	Signals map[string]string `yaml:"signals"`
+}
+
+// loads and validates a taxonomy and the signal names from the given YAML
+// file, which looks like
+//
+//	classes:
+//	    - class: AHU
+//	      interface: AHU
+//	      precedence: 1
+//	signals:
+//	    Zone_Temperature_Sensor: zone_temp
+//
+// The signal names are the defaults if the file has none
+func loadTaxonomy(filename string) (taxonomy, map[string]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Could not read taxonomy file %s", filename)
+	}
+	var file taxonomyFile
+	if err := yaml.UnmarshalStrict(contents, &file); err != nil {
+		return nil, nil, errors.Wrapf(err, "Could not parse taxonomy file %s", filename)
+	}
+	if err := file.Classes.validate(); err != nil {
+		return nil, nil, errors.Wrapf(err, "Invalid taxonomy in %s", filename)
+	}
+	for class, signal := range file.Signals {
+		if signal == "" || signal != signalSegment(signal) {
+			return nil, nil, fmt.Errorf("Invalid taxonomy in %s: signal name %q for class %s must be lowercase letters, digits and underscores", filename, signal, class)
+		}
+	}
+	if len(file.Signals) == 0 {
+		file.Signals = defaultSignalNames
+	}
+	file.Classes.sort()
+	return file.Classes, file.Signals, nil
+}
+
+// checks that every entry is complete and that no two entries overlap
+func (t taxonomy) validate() error {
+	if len(t) == 0 {
+		return errors.New("Taxonomy has no classes")
+	}
+	var (
+		byClass      = make(map[string]int)
+		byPrecedence = make(map[int]string)
+	)
+	for i, entry := range t {
+		if entry.Class == "" {
+			return fmt.Errorf("Entry %d has no class", i)
+		}
+		if strings.ContainsAny(entry.Class, ": \t") {
+			return fmt.Errorf("Class %q should be a Brick class name without a namespace", entry.Class)
+		}
+		if entry.Interface == "" {
+			return fmt.Errorf("Class %s has no interface name", entry.Class)
+		}
+		if strings.ContainsAny(entry.Interface, "/*+!. \t") {
+			return fmt.Errorf("Interface name %q for class %s is not a valid URI segment", entry.Interface, entry.Class)
+		}
+		if prev, found := byClass[entry.Class]; found {
+			return fmt.Errorf("Class %s is listed more than once (entries %d and %d)", entry.Class, prev, i)
+		}
+		if other, found := byPrecedence[entry.Precedence]; found {
+			return fmt.Errorf("Classes %s and %s have the same precedence %d", other, entry.Class, entry.Precedence)
+		}
+		byClass[entry.Class] = i
+		byPrecedence[entry.Precedence] = entry.Class
+	}
+	return nil
+}
+
+func (t taxonomy) sort() {
+	sort.Slice(t, func(i, j int) bool {
+		return t[i].Precedence < t[j].Precedence
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTaxonomyValidate(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		t     taxonomy
+		valid bool
+	}{
+		{"default", defaultTaxonomy, true},
+		{"empty", taxonomy{}, false},
+		{"no class", taxonomy{{Interface: "VAV", Precedence: 1}}, false},
+		{"namespaced class", taxonomy{{Class: "brick:VAV", Interface: "VAV", Precedence: 1}}, false},
+		{"no interface", taxonomy{{Class: "VAV", Precedence: 1}}, false},
+		{"interface with slash", taxonomy{{Class: "VAV", Interface: "V/AV", Precedence: 1}}, false},
+		{"interface with wildcard", taxonomy{{Class: "VAV", Interface: "VAV*", Precedence: 1}}, false},
+		{"duplicate class", taxonomy{{Class: "VAV", Interface: "VAV", Precedence: 1}, {Class: "VAV", Interface: "Box", Precedence: 2}}, false},
+		{"duplicate precedence", taxonomy{{Class: "VAV", Interface: "VAV", Precedence: 1}, {Class: "AHU", Interface: "AHU", Precedence: 1}}, false},
+	} {
+		if err := test.t.validate(); (err == nil) != test.valid {
+			t.Errorf("%s: validate returned %v", test.name, err)
+		}
+	}
+}
+
+func writeTaxonomy(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "taxonomy.yml")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadTaxonomy(t *testing.T) {
+	classes, signals, err := loadTaxonomy(writeTaxonomy(t, `
+classes:
+    - class: VAV
+      interface: VAV
+      precedence: 2
+    - class: AHU
+      interface: AHU
+      precedence: 1
+signals:
+    Zone_Temperature_Sensor: znt
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := taxonomy{
+		{Class: "AHU", Interface: "AHU", Precedence: 1},
+		{Class: "VAV", Interface: "VAV", Precedence: 2},
+	}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Loaded classes %+v, expected them sorted by precedence", classes)
+	}
+	if !reflect.DeepEqual(signals, map[string]string{"Zone_Temperature_Sensor": "znt"}) {
+		t.Errorf("Loaded signals %v", signals)
+	}
+
+	// without signal names, the defaults are used
+	_, signals, err = loadTaxonomy(writeTaxonomy(t, "classes:\n    - {class: VAV, interface: VAV, precedence: 1}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(signals, defaultSignalNames) {
+		t.Errorf("Expected the default signal names, got %v", signals)
+	}
+}
+
+func TestLoadTaxonomyInvalid(t *testing.T) {
+	for name, contents := range map[string]string{
+		"unknown field":      "classes:\n    - {class: VAV, interface: VAV, precedence: 1, color: red}\n",
+		"no classes":         "signals:\n    Zone_Temperature_Sensor: znt\n",
+		"invalid class":      "classes:\n    - {class: VAV, precedence: 1}\n",
+		"invalid signal":     "classes:\n    - {class: VAV, interface: VAV, precedence: 1}\nsignals:\n    Zone_Temperature_Sensor: Zone Temp\n",
+		"empty signal":       "classes:\n    - {class: VAV, interface: VAV, precedence: 1}\nsignals:\n    Zone_Temperature_Sensor: \"\"\n",
+		"not a taxonomy":     "- VAV\n- AHU\n",
+		"malformed document": "classes: [\n",
+	} {
+		if _, _, err := loadTaxonomy(writeTaxonomy(t, contents)); err == nil {
+			t.Errorf("%s: loaded invalid taxonomy", name)
+		}
+	}
+	if _, _, err := loadTaxonomy(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("Loaded a missing taxonomy file")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var TimeConvertErr = errors.New("Over/underflow error in converting time")
+
+func ParseUOT(units string) (UnitOfTime, error) {
+	switch units {
+	case "s", "sec", "second", "seconds":
+		return UOT_S, nil
+	case "us", "usec", "microsecond", "microseconds":
+		return UOT_US, nil
+	case "ms", "msec", "millisecond", "milliseconds":
+		return UOT_MS, nil
+	case "ns", "nsec", "nanosecond", "nanoseconds":
+		return UOT_NS, nil
+	default:
+		return UOT_S, fmt.Errorf("Invalid unit %v. Must be s,us,ms,ns", units)
+	}
+}
+
+// unit of time indicators
+type UnitOfTime uint
+
+const (
+	// nanoseconds 1000000000
+	UOT_NS UnitOfTime = 1
+	// microseconds 1000000
+	UOT_US UnitOfTime = 2
+	// milliseconds 1000
+	UOT_MS UnitOfTime = 3
+	// seconds 1
+	UOT_S UnitOfTime = 4
+)
+
+var unitmultiplier = map[UnitOfTime]uint64{
+	UOT_NS: 1000000000,
+	UOT_US: 1000000,
+	UOT_MS: 1000,
+	UOT_S:  1,
+}
+
+// Takes a timestamp with accompanying unit of time 'stream_uot' and
+// converts it to the unit of time 'target_uot'
+func ConvertTime(time uint64, stream_uot, target_uot UnitOfTime) (uint64, error) {
+	var returnTime uint64
+	if stream_uot == target_uot {
+		return time, nil
+	}
+	if target_uot < stream_uot { // target/stream is > 1, so we can use uint64
+		mult := unitmultiplier[target_uot] / unitmultiplier[stream_uot]
+		if time > math.MaxUint64/mult {
+			return time, TimeConvertErr
+		}
+		returnTime = time * mult
+	} else {
+		returnTime = time / uint64(unitmultiplier[stream_uot]/unitmultiplier[target_uot])
+	}
+	return returnTime, nil
+}
+
+func (u UnitOfTime) String() string {
+	switch u {
+	case UOT_NS:
+		return "ns"
+	case UOT_US:
+		return "us"
+	case UOT_MS:
+		return "ms"
+	case UOT_S:
+		return "s"
+	default:
+		return ""
+	}
+}
+
+func (u UnitOfTime) MarshalJSON() ([]byte, error) {
+	switch u {
+	case UOT_NS:
+		return []byte(`"ns"`), nil
+	case UOT_US:
+		return []byte(`"us"`), nil
+	case UOT_MS:
+		return []byte(`"ms"`), nil
+	case UOT_S:
+		return []byte(`"s"`), nil
+	default:
+		return []byte(`"s"`), nil
+	}
+}
+
+func (u *UnitOfTime) UnmarshalJSON(b []byte) (err error) {
+	str := strings.Trim(string(b), `"`)
+	switch str {
+	case "ns":
+		*u = UOT_NS
+	case "us":
+		*u = UOT_US
+	case "ms":
+		*u = UOT_MS
+	case "s":
+		*u = UOT_S
+	default:
+		return fmt.Errorf("%v is not a valid UnitOfTime", str)
+	}
+	return nil
+}
+
+// Lower bounds for guessing the unit of a timestamp. Present-day timestamps
+// are around 1e9 in s, 1e12 in ms, 1e15 in us and 1e18 in ns, so each bound
+// sits three orders of magnitude below the next unit's present-day value:
+// 1e11 s is the year 5138, and 1e11 ms is 1973
+const (
+	MS_LOW uint64 = 1e11
+	US_LOW uint64 = 1e14
+	NS_LOW uint64 = 1e17
+)
+
+func GuessTimeUnit(val uint64) UnitOfTime {
+	if val < MS_LOW {
+		return UOT_S
+	} else if val < US_LOW {
+		return UOT_MS
+	} else if val < NS_LOW {
+		return UOT_US
+	}
+	return UOT_NS
+}
+
+// Parses a sMAP timestamp in the given unit of time and converts it to the
+// target unit. If the unit of time is not known (0), it is guessed from the
+// magnitude of the timestamp
+func normalizeTime(raw json.Number, stream_uot, target_uot UnitOfTime) (int64, error) {
+	var time uint64
+	if i, err := raw.Int64(); err == nil && i >= 0 {
+		time = uint64(i)
+	} else if f, err := raw.Float64(); err == nil && f >= 0 {
+		// some drivers report fractional timestamps
+		if stream_uot == 0 {
+			stream_uot = GuessTimeUnit(uint64(f))
+		}
+		return convertFloatTime(f, stream_uot, target_uot)
+	} else {
+		return 0, fmt.Errorf("Invalid timestamp %s", raw)
+	}
+	if stream_uot == 0 {
+		stream_uot = GuessTimeUnit(time)
+	}
+	converted, err := ConvertTime(time, stream_uot, target_uot)
+	if err != nil {
+		return 0, err
+	}
+	if converted > math.MaxInt64 {
+		return 0, TimeConvertErr
+	}
+	return int64(converted), nil
+}
+
+// Converts a fractional timestamp to the target unit, scaling it before
+// truncating so that the fraction of the stream's unit is kept
+func convertFloatTime(time float64, stream_uot, target_uot UnitOfTime) (int64, error) {
+	scaled := time * float64(unitmultiplier[target_uot]) / float64(unitmultiplier[stream_uot])
+	if scaled >= math.MaxInt64 {
+		return 0, TimeConvertErr
+	}
+	return int64(scaled), nil
+}
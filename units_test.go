@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestGuessTimeUnit(t *testing.T) {
+	for _, test := range []struct {
+		time     uint64
+		expected UnitOfTime
+	}{
+		{0, UOT_S},
+		{1500000000, UOT_S},
+		{MS_LOW - 1, UOT_S},
+		{MS_LOW, UOT_MS},
+		{1500000000000, UOT_MS},
+		{US_LOW, UOT_US},
+		{1500000000000000, UOT_US},
+		{NS_LOW, UOT_NS},
+		{1500000000000000000, UOT_NS},
+		{math.MaxUint64, UOT_NS},
+	} {
+		if unit := GuessTimeUnit(test.time); unit != test.expected {
+			t.Errorf("Guessed %s for %d, expected %s", unit, test.time, test.expected)
+		}
+	}
+}
+
+func TestConvertTime(t *testing.T) {
+	for _, test := range []struct {
+		time     uint64
+		from, to UnitOfTime
+		expected uint64
+		err      error
+	}{
+		{1500000000, UOT_S, UOT_S, 1500000000, nil},
+		{1500000000, UOT_S, UOT_NS, 1500000000000000000, nil},
+		{1500000000123, UOT_MS, UOT_US, 1500000000123000, nil},
+		{1500000000123456789, UOT_NS, UOT_MS, 1500000000123, nil},
+		{1500000000999, UOT_MS, UOT_S, 1500000000, nil},
+		{math.MaxUint64 / 1000, UOT_MS, UOT_US, math.MaxUint64 / 1000 * 1000, nil},
+		{math.MaxUint64/1000 + 1, UOT_MS, UOT_US, 0, TimeConvertErr},
+		{1500000000000000000, UOT_S, UOT_NS, 0, TimeConvertErr},
+	} {
+		converted, err := ConvertTime(test.time, test.from, test.to)
+		if err != test.err {
+			t.Errorf("Converting %d %s to %s: got error %v, expected %v", test.time, test.from, test.to, err, test.err)
+		} else if err == nil && converted != test.expected {
+			t.Errorf("Converted %d %s to %d %s, expected %d", test.time, test.from, converted, test.to, test.expected)
+		}
+	}
+}
+
+func TestNormalizeTime(t *testing.T) {
+	for _, test := range []struct {
+		raw      string
+		from, to UnitOfTime
+		expected int64
+		err      bool
+	}{
+		{"1500000000", UOT_S, UOT_NS, 1500000000000000000, false},
+		{"1500000000000", UOT_MS, UOT_S, 1500000000, false},
+		// the unit is guessed when the stream doesn't give one
+		{"1500000000", 0, UOT_MS, 1500000000000, false},
+		{"1500000000000", 0, UOT_MS, 1500000000000, false},
+		{"1500000000000000", 0, UOT_MS, 1500000000000, false},
+		{"1500000000000000000", 0, UOT_MS, 1500000000000, false},
+		// fractions are kept down to the target unit
+		{"1500000000.5", UOT_S, UOT_MS, 1500000000500, false},
+		{"1500000000.25", 0, UOT_US, 1500000000250000, false},
+		{"1500000000000.5", UOT_MS, UOT_US, 1500000000000500, false},
+		{"1500000000.5", UOT_S, UOT_S, 1500000000, false},
+		{"1.5e9", UOT_S, UOT_MS, 1500000000000, false},
+		// overflows int64 nanoseconds
+		{"10000000000", UOT_S, UOT_NS, 0, true},
+		{"10000000000.5", UOT_S, UOT_NS, 0, true},
+		{"-1", UOT_S, UOT_NS, 0, true},
+		{"-1.5", UOT_S, UOT_NS, 0, true},
+	} {
+		converted, err := normalizeTime(json.Number(test.raw), test.from, test.to)
+		if (err != nil) != test.err {
+			t.Errorf("Normalizing %s: got error %v", test.raw, err)
+		} else if converted != test.expected {
+			t.Errorf("Normalized %s %s to %d %s, expected %d", test.raw, test.from, converted, test.to, test.expected)
+		}
+	}
+
+	// nanosecond floats can't be exact, but must keep the fraction
+	converted, err := normalizeTime("1500000000.123", UOT_S, UOT_NS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := converted - 1500000000123000000; diff < -1000 || diff > 1000 {
+		t.Errorf("Normalized 1500000000.123 s to %d ns", converted)
+	}
+}
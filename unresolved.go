@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a UUID that none of the resolvers knew about
+type unresolvedPoint struct {
+	UUID string
+	Path string
+	// the config source name, or the VK for ad hoc reports
+	Source    string
+	BaseURI   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// number of readings received since FirstSeen
+	Readings int
+}
+
+// keeps track of the UUIDs we couldn't resolve so operators can fix the model
+type unresolvedTracker struct {
+	points map[string]*unresolvedPoint
+	sync.Mutex
+}
+
+func newUnresolvedTracker() *unresolvedTracker {
+	return &unresolvedTracker{
+		points: make(map[string]*unresolvedPoint),
+	}
+}
+
+// records that the timeseries in the message could not be resolved
+func (t *unresolvedTracker) add(src *source, msg SmapMessage) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	point, found := t.points[msg.UUID]
+	if !found {
+		point = &unresolvedPoint{UUID: msg.UUID, FirstSeen: now}
+		t.points[msg.UUID] = point
+		log.Warningf("Could not resolve UUID %s (%s)", msg.UUID, msg.Path)
+	}
+	point.Path = msg.Path
+	point.Source = src.label()
+	point.BaseURI = src.baseuri
+	point.LastSeen = now
+	point.Readings += len(msg.Readings)
+}
+
+// forgets the UUID once it resolves
+func (t *unresolvedTracker) remove(uuid string) {
+	t.Lock()
+	defer t.Unlock()
+	if _, found := t.points[uuid]; found {
+		log.Noticef("UUID %s is now resolved", uuid)
+		delete(t.points, uuid)
+	}
+}
+
+// returns the unresolved points, sorted by UUID
+func (t *unresolvedTracker) list() []unresolvedPoint {
+	t.Lock()
+	defer t.Unlock()
+	var points = make([]unresolvedPoint, 0, len(t.points))
+	for _, point := range t.points {
+		points = append(points, *point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].UUID < points[j].UUID
+	})
+	return points
+}
+
+// lists the UUIDs that we couldn't resolve
+func (s *server) listUnresolved(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.unresolved.list())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// URI templates for the two ways of mapping sMAP onto BOSSWAVE
+const (
+	// Brick-aware mapping using the point and equipment from Hod
+	brickTemplate = "{base}/s.bms/{equip}/i.{interface}/signal/{signal}"
+	// the original sWAP mapping of sMAP paths under the base URI
+	pathTemplate = "{base}/{path}"
+	// where we publish timeseries whose UUID can't be resolved
+	fallbackTemplate = "{base}/s.smap/unmapped/{uuid}"
+	// disables publishing unresolved timeseries
+	noFallback = "none"
+)
+
+var templateVar = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Characters other than these can't appear in a URI segment: '/' separates
+// segments, '+' and '*' are wildcards, '!' starts a meta segment and
+// whitespace and control characters are never valid
+var unsafeURIChars = regexp.MustCompile(`[^A-Za-z0-9_.:@=,~-]`)
+
+// placeholders like {Metadata.Location.Building} take the value of that key
+// of the timeseries' (inherited) sMAP Metadata
+const metadataPlaceholder = "Metadata."
+
+// the placeholders that can be used in a URI template. Those set to true only
+// have values for points resolved to Brick
+var templateVars = map[string]bool{
+	"base":       false,
+	"path":       false,
+	"uuid":       false,
+	"name":       false,
+	"equip":      true,
+	"equipclass": true,
+	"class":      true,
+	"interface":  true,
+	"signal":     true,
+}
+
+// Returns an error if the template uses an unknown placeholder or its literal
+// parts are not valid URI segments. Unless brick is true, placeholders that
+// need a Brick point are rejected too
+func checkTemplate(template string, brick bool) error {
+	if strings.TrimSpace(template) == "" {
+		return errors.New("URI template is empty")
+	}
+	for _, match := range templateVar.FindAllStringSubmatch(template, -1) {
+		name := match[1]
+		if strings.HasPrefix(name, metadataPlaceholder) {
+			if name == metadataPlaceholder {
+				return fmt.Errorf("Placeholder %s in URI template %s has no metadata key", match[0], template)
+			}
+			continue
+		}
+		needsBrick, found := templateVars[name]
+		if !found {
+			return fmt.Errorf("Unknown placeholder %s in URI template %s", match[0], template)
+		}
+		if needsBrick && !brick {
+			return fmt.Errorf("Placeholder %s in URI template %s needs points resolved to Brick", match[0], template)
+		}
+	}
+	// what is left must be valid URI segments
+	literal := templateVar.ReplaceAllString(template, "x")
+	if strings.ContainsAny(literal, "{}") {
+		return fmt.Errorf("Unbalanced braces in URI template %s", template)
+	}
+	for _, segment := range strings.Split(literal, "/") {
+		if unsafeURIChars.MatchString(segment) {
+			return fmt.Errorf("URI template %s has an invalid segment %q", template, segment)
+		}
+	}
+	return nil
+}
+
+// returns an error if the URI is empty or any of its segments is empty or
+// contains characters that aren't allowed in a URI segment
+func checkURI(uri string) error {
+	if uri == "" {
+		return errors.New("URI is empty")
+	}
+	for _, segment := range strings.Split(uri, "/") {
+		if segment == "" {
+			return fmt.Errorf("URI %s has an empty segment", uri)
+		}
+		if unsafeURIChars.MatchString(segment) {
+			return fmt.Errorf("URI %s has an invalid segment %q", uri, segment)
+		}
+	}
+	return nil
+}
+
+// Fills in the placeholders in the template from the given values and the
+// sMAP metadata. Values are sanitized so each becomes a single URI segment,
+// except for {base}, which was checked when the source was set up, and
+// {path}, whose segments are sanitized one by one. Returns an error if the
+// template uses a metadata key the timeseries doesn't have, or a placeholder
+// is empty, since dropping it would publish on another URI
+func expandTemplate(template string, values map[string]string, metadata map[string]interface{}) (string, error) {
+	var err error
+	uri := templateVar.ReplaceAllStringFunc(template, func(match string) string {
+		name := match[1 : len(match)-1]
+		var value string
+		switch {
+		case name == "base":
+			return values[name]
+		case name == "path":
+			value = sanitizePath(values[name])
+		case strings.HasPrefix(name, metadataPlaceholder):
+			key := strings.TrimPrefix(name, metadataPlaceholder)
+			md, found := metadata[key]
+			if !found {
+				if err == nil {
+					err = fmt.Errorf("URI template %s needs Metadata/%s, which is not set", template, strings.Replace(key, ".", "/", -1))
+				}
+				return ""
+			}
+			value = sanitizeSegment(fmt.Sprintf("%v", md))
+		default:
+			value = sanitizeSegment(values[name])
+		}
+		if value == "" && err == nil {
+			err = fmt.Errorf("URI template %s needs %s, which is empty", template, match)
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	for strings.Contains(uri, "//") {
+		uri = strings.Replace(uri, "//", "/", -1)
+	}
+	uri = strings.Trim(uri, "/")
+	if uri == "" {
+		return "", fmt.Errorf("URI template %s expands to an empty URI", template)
+	}
+	return uri, nil
+}
+
+// replaces the characters that aren't allowed in a URI segment (including
+// '/') with underscores
+func sanitizeSegment(value string) string {
+	return unsafeURIChars.ReplaceAllString(strings.Trim(value, "/"), "_")
+}
+
+// sanitizes each segment of a sMAP path, dropping empty ones
+func sanitizePath(path string) string {
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, sanitizeSegment(segment))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Returns the interface URI that a publish URI belongs to, i.e. everything
+// before the signal segment, so that slots and signals of the same interface
+// end up next to each other. URIs without a signal segment are their own
+// interface
+func interfaceURI(uri string) string {
+	segments := strings.Split(uri, "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i] == "signal" {
+			return strings.Join(segments[:i], "/")
+		}
+	}
+	return uri
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckTemplate(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		brick    bool
+		valid    bool
+	}{
+		{brickTemplate, true, true},
+		{brickTemplate, false, false},
+		{pathTemplate, false, true},
+		{fallbackTemplate, false, true},
+		{"{base}/{Metadata.Location.Building}/{path}", false, true},
+		{"{base}/{Metadata.}/{path}", false, false},
+		{"{base}/{unknown}", true, false},
+		{"{base}/{path", false, false},
+		{"{base}/path}", false, false},
+		{"{base}/*/{path}", false, false},
+		{"{base}/a+b/{path}", false, false},
+		{"{base}/!meta/{path}", false, false},
+		{"{base}/with space/{path}", false, false},
+		{"", false, false},
+		{"   ", false, false},
+	} {
+		if err := checkTemplate(test.template, test.brick); (err == nil) != test.valid {
+			t.Errorf("checkTemplate(%q, %v) returned %v", test.template, test.brick, err)
+		}
+	}
+}
+
+func TestCheckURI(t *testing.T) {
+	for uri, valid := range map[string]bool{
+		"scratch.ns/soda":       true,
+		"scratch.ns/soda/a_b-c": true,
+		"":                      false,
+		"scratch.ns//soda":      false,
+		"scratch.ns/soda/":      false,
+		"scratch.ns/+/soda":     false,
+		"scratch.ns/soda*":      false,
+		"scratch.ns/so da":      false,
+	} {
+		if err := checkURI(uri); (err == nil) != valid {
+			t.Errorf("checkURI(%q) returned %v", uri, err)
+		}
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	values := map[string]string{
+		"base":       "scratch.ns/soda",
+		"path":       "/vav 1//temp",
+		"uuid":       "b8b8c55e-2a5b-11e7-93ae-92361f002671",
+		"name":       "soda#VAV1 ZNT",
+		"equip":      "soda#VAV1",
+		"equipclass": "",
+		"interface":  "VAV",
+		"signal":     "zone_temp",
+	}
+	metadata := map[string]interface{}{
+		"Location.Building": "Soda Hall",
+		"Location.Floor":    4,
+		"Location.Room":     "",
+	}
+	for _, test := range []struct {
+		template string
+		expected string
+		valid    bool
+	}{
+		{brickTemplate, "scratch.ns/soda/s.bms/soda_VAV1/i.VAV/signal/zone_temp", true},
+		{pathTemplate, "scratch.ns/soda/vav_1/temp", true},
+		{fallbackTemplate, "scratch.ns/soda/s.smap/unmapped/b8b8c55e-2a5b-11e7-93ae-92361f002671", true},
+		{"{base}/{name}", "scratch.ns/soda/soda_VAV1_ZNT", true},
+		{"{base}/{Metadata.Location.Building}/{Metadata.Location.Floor}/{path}", "scratch.ns/soda/Soda_Hall/4/vav_1/temp", true},
+		// missing or empty values would drop a segment
+		{"{base}/{Metadata.Location.Campus}/{path}", "", false},
+		{"{base}/{Metadata.Location.Room}/{path}", "", false},
+		{"{base}/{equipclass}/{signal}", "", false},
+	} {
+		uri, err := expandTemplate(test.template, values, metadata)
+		if (err == nil) != test.valid {
+			t.Errorf("Expanding %s returned %v", test.template, err)
+		} else if uri != test.expected {
+			t.Errorf("Expanded %s to %s, expected %s", test.template, uri, test.expected)
+		}
+	}
+}
+
+func TestInterfaceURI(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"scratch.ns/soda/s.bms/VAV1/i.VAV/signal/zone_temp": "scratch.ns/soda/s.bms/VAV1/i.VAV",
+		"scratch.ns/signal/s.bms/VAV1/i.VAV/signal/info":    "scratch.ns/signal/s.bms/VAV1/i.VAV",
+		"scratch.ns/soda/vav1/temp":                         "scratch.ns/soda/vav1/temp",
+	} {
+		if iface := interfaceURI(uri); iface != expected {
+			t.Errorf("Interface of %s is %s, expected %s", uri, iface, expected)
+		}
+	}
+}